@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// yarnBinary is an executable of an installed package, as listed by `yarn bin --json` (Yarn Berry).
+type yarnBinary struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// installedBinDirs returns the directories containing the executables of the installed packages:
+// node_modules/.bin, or for Plug'n'Play installs a directory of shims running the executables with the PnP runtime.
+func installedBinDirs(yarn yarnExecutable, yarnMajor uint64, workDir string) ([]string, error) {
+	if pth := nodeModulesBinPath(workDir); pth != "" {
+		return []string{pth}, nil
+	}
+
+	if yarnMajor >= 2 && isPnPInstall(workDir) {
+		shimDir, err := createPnPShims(yarn, workDir)
+		if err != nil {
+			return nil, err
+		}
+		return []string{shimDir}, nil
+	}
+	return nil, nil
+}
+
+func listYarnBinaries(yarn yarnExecutable, workDir string) ([]yarnBinary, error) {
+	out, err := yarn.command("bin", "--json").SetDir(workDir).RunAndReturnTrimmedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s, out: %s", err, out)
+	}
+
+	var binaries []yarnBinary
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var binary yarnBinary
+		if err := json.Unmarshal([]byte(line), &binary); err != nil {
+			return nil, fmt.Errorf("failed to parse yarn bin output: %s", err)
+		}
+		if binary.Name != "" && binary.Path != "" {
+			binaries = append(binaries, binary)
+		}
+	}
+	return binaries, nil
+}
+
+// createPnPShims writes a shell script for every binary of the installed packages, running it with Node.js
+// and the PnP runtime of the project loaded.
+func createPnPShims(yarn yarnExecutable, workDir string) (string, error) {
+	binaries, err := listYarnBinaries(yarn, workDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to list binaries: %s", err)
+	}
+
+	shimDir, err := os.MkdirTemp("", "yarn-pnp-bin")
+	if err != nil {
+		return "", fmt.Errorf("failed to create shim directory: %s", err)
+	}
+
+	pnpRuntime := filepath.Join(workDir, ".pnp.cjs")
+	for _, binary := range binaries {
+		shim := fmt.Sprintf("#!/bin/sh\nexec node --require %s \"$@\"\n", shellquote.Join(pnpRuntime, binary.Path))
+		if err := os.WriteFile(filepath.Join(shimDir, binary.Name), []byte(shim), 0755); err != nil {
+			return "", fmt.Errorf("failed to write shim of %s: %s", binary.Name, err)
+		}
+	}
+	return shimDir, nil
+}
+
+// exportYarnShim adds a `yarn` executable running the Yarn in use to the PATH of the step and the subsequent Steps,
+// for Yarn releases run by node instead of an installed yarn (like the ones of the tool cache).
+func exportYarnShim(yarn yarnExecutable) error {
+	shimDir, err := os.MkdirTemp("", "yarn-bin")
+	if err != nil {
+		return fmt.Errorf("failed to create shim directory: %s", err)
+	}
+
+	shim := fmt.Sprintf("#!/bin/sh\nexec %s \"$@\"\n", shellquote.Join(append([]string{yarn.name}, yarn.args...)...))
+	if err := os.WriteFile(filepath.Join(shimDir, "yarn"), []byte(shim), 0755); err != nil {
+		return fmt.Errorf("failed to write yarn shim: %s", err)
+	}
+
+	exportBinPath([]string{shimDir})
+	// Later PATH exports of the step are based on the PATH of the step
+	return os.Setenv("PATH", shimDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// exportBinPath exports the PATH for the subsequent Steps with the given directories prepended.
+func exportBinPath(dirs []string) {
+	exportOutput("PATH", strings.Join(append(dirs, os.Getenv("PATH")), string(os.PathListSeparator)))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const cacheArchiveExt = ".tar.gz"
+
+// cacheStorage stores cache archives by key.
+type cacheStorage interface {
+	// restore copies the archive of the first key with a stored archive to dst and returns the key it was stored with.
+	// The first key has to match exactly, the rest of them are prefixes matched against the stored keys
+	// (the most recently saved matching archive is used). An empty key is returned if none of them matches.
+	restore(keys []string, dst string) (string, error)
+	// save stores the archive with the given key.
+	save(key, src string) error
+}
+
+// localCacheStorage stores the cache archives in a local directory.
+type localCacheStorage struct {
+	dir string
+}
+
+func (s localCacheStorage) restore(keys []string, dst string) (string, error) {
+	for i, key := range keys {
+		var matched string
+		var err error
+		if i == 0 {
+			matched, err = s.findExact(key)
+		} else {
+			matched, err = s.findLatestWithPrefix(key)
+		}
+		if err != nil {
+			return "", err
+		}
+		if matched == "" {
+			continue
+		}
+
+		if err := copyFile(s.archivePath(matched), dst); err != nil {
+			return "", fmt.Errorf("failed to copy cache archive: %s", err)
+		}
+		return matched, nil
+	}
+	return "", nil
+}
+
+func (s localCacheStorage) findExact(key string) (string, error) {
+	if _, err := os.Stat(s.archivePath(key)); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to check cache archive: %s", err)
+	}
+	return key, nil
+}
+
+func (s localCacheStorage) findLatestWithPrefix(prefix string) (string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to list cache archives: %s", err)
+	}
+
+	var latest string
+	var latestModTime int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, cacheArchiveExt) {
+			continue
+		}
+		key, err := url.PathUnescape(strings.TrimSuffix(name, cacheArchiveExt))
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return "", fmt.Errorf("failed to check cache archive: %s", err)
+		}
+		if modTime := info.ModTime().UnixNano(); latest == "" || modTime > latestModTime {
+			latest, latestModTime = key, modTime
+		}
+	}
+	return latest, nil
+}
+
+func (s localCacheStorage) save(key, src string) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %s", err)
+	}
+
+	// Copied next to the final path first, so that a failed save doesn't leave a partial archive behind
+	tmpPth := s.archivePath(key) + ".tmp"
+	if err := copyFile(src, tmpPth); err != nil {
+		_ = os.Remove(tmpPth)
+		return fmt.Errorf("failed to copy cache archive: %s", err)
+	}
+	if err := os.Rename(tmpPth, s.archivePath(key)); err != nil {
+		return fmt.Errorf("failed to store cache archive: %s", err)
+	}
+	return nil
+}
+
+// archivePath returns the path of the archive of the key, the key is escaped to be safe (and reversible) as a file name.
+func (s localCacheStorage) archivePath(key string) string {
+	return filepath.Join(s.dir, url.PathEscape(key)+cacheArchiveExt)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
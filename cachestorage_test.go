@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeArchive(t *testing.T, dir, content string) string {
+	t.Helper()
+	pth := filepath.Join(dir, "archive"+cacheArchiveExt)
+	if err := os.WriteFile(pth, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return pth
+}
+
+func TestLocalCacheStorage(t *testing.T) {
+	storage := localCacheStorage{dir: filepath.Join(t.TempDir(), "cache")}
+	src := t.TempDir()
+
+	saved := map[string]time.Time{
+		"yarn-linux-old":      time.Now().Add(-2 * time.Hour),
+		"yarn-linux-new":      time.Now().Add(-1 * time.Hour),
+		"yarn/darwin:1 2 3":   time.Now(),
+		"other-linux-newest!": time.Now(),
+	}
+	for key, modTime := range saved {
+		if err := storage.save(key, writeArchive(t, src, key)); err != nil {
+			t.Fatalf("save %s: %s", key, err)
+		}
+		if err := os.Chtimes(storage.archivePath(key), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		keys []string
+		want string
+	}{
+		{name: "exact key", keys: []string{"yarn-linux-old", "yarn-"}, want: "yarn-linux-old"},
+		{name: "exact key with special characters", keys: []string{"yarn/darwin:1 2 3"}, want: "yarn/darwin:1 2 3"},
+		{name: "the first key is not a prefix", keys: []string{"yarn-linux-"}, want: ""},
+		{name: "latest archive of a restore key", keys: []string{"yarn-linux-missing", "yarn-linux-"}, want: "yarn-linux-new"},
+		{name: "restore keys in order", keys: []string{"missing", "nothing-", "yarn/"}, want: "yarn/darwin:1 2 3"},
+		{name: "no match", keys: []string{"missing", "nothing-"}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "restored"+cacheArchiveExt)
+			got, err := storage.restore(tt.keys, dst)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != tt.want {
+				t.Fatalf("got key %q, want %q", got, tt.want)
+			}
+			if got == "" {
+				return
+			}
+
+			content, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tt.want {
+				t.Errorf("restored the archive of %q instead of %q", content, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalCacheStorageRestoreWithoutDirectory(t *testing.T) {
+	storage := localCacheStorage{dir: filepath.Join(t.TempDir(), "missing")}
+	got, err := storage.restore([]string{"key", "prefix-"}, filepath.Join(t.TempDir(), "restored"+cacheArchiveExt))
+	if err != nil || got != "" {
+		t.Errorf("got %q, %v, want no key and no error", got, err)
+	}
+}
+
+func TestKeyCache(t *testing.T) {
+	storage := localCacheStorage{dir: t.TempDir()}
+	workDir := t.TempDir()
+	createFixtureTree(t, workDir, []string{"yarn.lock", "node_modules/a/index.js"})
+
+	keyCacheFor := func(workDir string) *keyCache {
+		c, err := newKeyCache(storage, workDir, `yarn-{{ os }}-{{ checksum "yarn.lock" }}`, []string{"yarn-{{ os }}-"}, []string{"node_modules"})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return c
+	}
+
+	saving := keyCacheFor(workDir)
+	if err := saving.restore(); err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+	if saving.restoredKey != "" {
+		t.Fatalf("restored %s from an empty storage", saving.restoredKey)
+	}
+	if err := saving.save(); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+
+	// A fresh clone with the same lockfile restores the exact key
+	cloneDir := t.TempDir()
+	createFixtureTree(t, cloneDir, []string{"yarn.lock"})
+	restoring := keyCacheFor(cloneDir)
+	if err := restoring.restore(); err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+	if restoring.restoredKey != saving.key {
+		t.Errorf("restored key %q, want %q", restoring.restoredKey, saving.key)
+	}
+	if _, err := os.Stat(filepath.Join(cloneDir, "node_modules", "a", "index.js")); err != nil {
+		t.Errorf("cached file not restored: %s", err)
+	}
+
+	// A changed lockfile restores the previous archive by the restore key
+	changedDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(changedDir, "yarn.lock"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed := keyCacheFor(changedDir)
+	if err := changed.restore(); err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+	if changed.restoredKey != saving.key || changed.key == saving.key {
+		t.Errorf("restored key %q with key %q, want %q by prefix", changed.restoredKey, changed.key, saving.key)
+	}
+}
+
+func TestNewKeyCacheMissingChecksumFile(t *testing.T) {
+	if _, err := newKeyCache(localCacheStorage{dir: t.TempDir()}, t.TempDir(), `yarn-{{ checksum "yarn.lock" }}`, nil, []string{"node_modules"}); err == nil {
+		t.Errorf("expected an error for a missing checksum file")
+	}
+}
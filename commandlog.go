@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// commandLogEnvPrefixes are the prefixes of the inherited environment variables affecting yarn,
+// their names are listed in the log file.
+var commandLogEnvPrefixes = []string{"YARN_", "NPM_CONFIG_", "npm_config_", "NODE_"}
+
+// commandLog writes the complete output of the yarn invocations to a file.
+type commandLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// createCommandLog creates the log file in the deploy directory and exports its path.
+func createCommandLog(yarnVersion, nodeVersion, workDir string) (*commandLog, error) {
+	l, err := newCommandLog(os.Getenv("BITRISE_DEPLOY_DIR"), yarnVersion, nodeVersion, workDir)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Saving the yarn output to: %s", l.path)
+	exportOutput("YARN_LOG_PATH", l.path)
+	return l, nil
+}
+
+// newCommandLog creates a timestamped log file in the given directory and writes the details of the environment to it.
+func newCommandLog(dir, yarnVersion, nodeVersion, workDir string) (*commandLog, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("BITRISE_DEPLOY_DIR is not set")
+	}
+
+	pth := filepath.Join(dir, fmt.Sprintf("yarn-%s.log", time.Now().Format("20060102-150405")))
+	file, err := os.Create(pth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create log file: %s", err)
+	}
+
+	l := &commandLog{path: pth, file: file}
+	l.printf("Yarn version: %s\n", yarnVersion)
+	l.printf("Node.js version: %s\n", nodeVersion)
+	l.printf("Working directory: %s\n", workDir)
+	if names := inheritedYarnEnvNames(); len(names) > 0 {
+		l.printf("Inherited environment variables: %s\n", strings.Join(names, ", "))
+	}
+	return l, nil
+}
+
+func inheritedYarnEnvNames() []string {
+	var names []string
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		for _, prefix := range commandLogEnvPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (l *commandLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Write(p)
+}
+
+func (l *commandLog) printf(format string, v ...interface{}) {
+	_, _ = fmt.Fprintf(l, format, v...)
+}
+
+// startInvocation writes the header of an invocation attempt.
+func (l *commandLog) startInvocation(commandLine, printableCommand, workDir string, attempt int, envs []string) {
+	l.printf("\n=== %s (attempt %d) ===\n", commandLine, attempt)
+	l.printf("$ %s\n", printableCommand)
+	l.printf("Directory: %s\n", workDir)
+	if len(envs) > 0 {
+		l.printf("Environment set by the step:\n")
+		for _, env := range envs {
+			l.printf("  %s\n", env)
+		}
+	}
+	l.printf("\n")
+}
+
+// finishInvocation writes the result of an invocation attempt.
+func (l *commandLog) finishInvocation(duration time.Duration, err error) {
+	if err == nil {
+		l.printf("\n=== Exit code: 0, duration: %.1fs ===\n", duration.Seconds())
+		return
+	}
+	l.printf("\n=== Exit code: %d, duration: %.1fs, error: %s ===\n", exitCode(err), duration.Seconds(), err)
+}
+
+// finish writes the summary of the run and closes the log.
+func (l *commandLog) finish(duration time.Duration, err error) error {
+	if err == nil {
+		l.printf("\n=== Finished in %.1fs, exit code: 0 ===\n", duration.Seconds())
+	} else {
+		l.printf("\n=== Failed in %.1fs, exit code: %d, reason: %s, error: %s ===\n", duration.Seconds(), exitCode(err), failureReason(err), err)
+	}
+	return l.close()
+}
+
+func (l *commandLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
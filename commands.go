@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+var classicCommands = []string{
+	"access", "add", "audit", "autoclean", "bin", "cache", "check", "config", "create", "exec",
+	"generate-lock-entry", "global", "help", "import", "info", "init", "install", "licenses", "link", "list",
+	"login", "logout", "node", "outdated", "owner", "pack", "policies", "publish", "remove", "run",
+	"tag", "team", "test", "unlink", "upgrade", "upgrade-interactive", "version", "versions", "why",
+	"workspace", "workspaces",
+}
+
+var berryCommands = []string{
+	"add", "bin", "cache", "config", "constraints", "dedupe", "dlx", "exec", "explain", "help",
+	"info", "init", "install", "link", "node", "npm", "pack", "patch", "patch-commit", "plugin",
+	"rebuild", "remove", "run", "search", "set", "stage", "unlink", "unplug", "up",
+	"upgrade-interactive", "version", "why", "workspace", "workspaces",
+}
+
+// unknownCommandError is returned for commands that are neither built-in yarn commands, package.json scripts
+// nor dependency binaries.
+type unknownCommandError struct {
+	message string
+}
+
+func (e *unknownCommandError) Error() string {
+	return e.message
+}
+
+// validateYarnCommand checks that the yarn command is a built-in command of the Yarn flavor in use,
+// a script of package.json or a binary of the installed dependencies, so typos fail before running yarn.
+// rootDir is the project root, it differs from workDir for the commands run in a workspace.
+func validateYarnCommand(yarnMajor uint64, workDir, rootDir string, pkg packageJSON, yarnCommand string) error {
+	if yarnCommand == "" || strings.HasPrefix(yarnCommand, "-") {
+		return nil
+	}
+
+	builtins, flavor, otherBuiltins, otherFlavor := classicCommands, "Yarn classic", berryCommands, "Yarn Berry"
+	if yarnMajor >= 2 {
+		builtins, flavor, otherBuiltins, otherFlavor = berryCommands, "Yarn Berry", classicCommands, "Yarn classic"
+	}
+
+	if containsString(builtins, yarnCommand) {
+		return nil
+	}
+	if _, ok := pkg.Scripts[yarnCommand]; ok {
+		return nil
+	}
+	// Workspaces can run the binaries of the dependencies hoisted to the root
+	for _, dir := range []string{workDir, rootDir} {
+		if _, err := os.Stat(filepath.Join(dir, "node_modules", ".bin", yarnCommand)); err == nil {
+			return nil
+		}
+	}
+
+	if yarnMajor >= 2 {
+		rc, err := readYarnrcYML(rootDir)
+		if err != nil {
+			return err
+		}
+		// Plugins and Plug'n'Play dependency binaries can add commands that can not be listed without running yarn
+		if len(rc.Plugins) > 0 || isPnPInstall(rootDir) {
+			log.Warnf("%s is not a built-in %s command or a package.json script, it might be provided by a plugin or a dependency", yarnCommand, flavor)
+			return nil
+		}
+	}
+
+	var scripts []string
+	for script := range pkg.Scripts {
+		scripts = append(scripts, script)
+	}
+	sort.Strings(scripts)
+
+	message := fmt.Sprintf("unknown yarn command: %s is not a built-in %s command, a package.json script or a dependency binary", yarnCommand, flavor)
+	if containsString(otherBuiltins, yarnCommand) {
+		message += fmt.Sprintf("\n%s is only available in %s", yarnCommand, otherFlavor)
+	}
+	if suggestions := closestMatches(yarnCommand, append(append([]string{}, builtins...), scripts...)); len(suggestions) > 0 {
+		message += fmt.Sprintf("\nDid you mean: %s", strings.Join(suggestions, ", "))
+	}
+	if len(scripts) > 0 {
+		message += fmt.Sprintf("\nAvailable scripts: %s", strings.Join(scripts, ", "))
+	}
+	return &unknownCommandError{message: message}
+}
+
+func isPnPInstall(workDir string) bool {
+	_, err := os.Stat(filepath.Join(workDir, ".pnp.cjs"))
+	return err == nil
+}
+
+// closestMatches returns the candidates within a small edit distance of name, closest first.
+func closestMatches(name string, candidates []string) []string {
+	const maxDistance = 2
+	const maxMatches = 3
+
+	type match struct {
+		candidate string
+		distance  int
+	}
+	var matches []match
+	for _, candidate := range candidates {
+		distance := levenshtein(name, candidate)
+		if distance <= maxDistance || strings.HasPrefix(candidate, name) {
+			matches = append(matches, match{candidate: candidate, distance: distance})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].distance < matches[j].distance
+	})
+
+	var names []string
+	for i := 0; i < len(matches) && i < maxMatches; i++ {
+		names = append(names, matches[i].candidate)
+	}
+	return names
+}
+
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func minInt(values ...int) int {
+	smallest := values[0]
+	for _, v := range values[1:] {
+		if v < smallest {
+			smallest = v
+		}
+	}
+	return smallest
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateYarnCommand(t *testing.T) {
+	rootDir := t.TempDir()
+	createFixtureTree(t, rootDir, []string{"node_modules/.bin/jest", "packages/a/node_modules/.bin/tsc", "packages/b/"})
+	pkg := packageJSON{Scripts: map[string]string{"build": "tsc"}}
+
+	tests := []struct {
+		name        string
+		workDir     string
+		command     string
+		wantUnknown bool
+	}{
+		{name: "built-in command", workDir: ".", command: "install"},
+		{name: "script", workDir: ".", command: "build"},
+		{name: "dependency binary", workDir: ".", command: "jest"},
+		{name: "workspace dependency binary", workDir: "packages/a", command: "tsc"},
+		{name: "hoisted dependency binary in a workspace", workDir: "packages/b", command: "jest"},
+		{name: "binary of another workspace", workDir: "packages/b", command: "tsc", wantUnknown: true},
+		{name: "typo", workDir: ".", command: "buidl", wantUnknown: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateYarnCommand(1, filepath.Join(rootDir, filepath.FromSlash(tt.workDir)), rootDir, pkg, tt.command)
+			var unknownErr *unknownCommandError
+			if isUnknown := errors.As(err, &unknownErr); isUnknown != tt.wantUnknown {
+				t.Errorf("got error %v, want unknown command error: %t", err, tt.wantUnknown)
+			}
+			if err != nil && !tt.wantUnknown {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
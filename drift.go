@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+)
+
+const lockfileDriftPatchName = "yarn-lockfile-drift.patch"
+
+// lockfileSnapshot holds the content of the lockfiles before running yarn, nil for missing files.
+type lockfileSnapshot struct {
+	workDir string
+	names   []string
+	files   map[string][]byte
+}
+
+// lockfileNames returns the files describing the resolved dependencies for the Yarn flavor in use.
+func lockfileNames(yarnMajor uint64) []string {
+	if yarnMajor >= 2 {
+		return []string{yarnLockFile, ".pnp.cjs"}
+	}
+	return []string{yarnLockFile}
+}
+
+func snapshotLockfiles(workDir string, names []string) (lockfileSnapshot, error) {
+	snapshot := lockfileSnapshot{workDir: workDir, names: names, files: map[string][]byte{}}
+	for _, name := range names {
+		content, err := os.ReadFile(filepath.Join(workDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return snapshot, fmt.Errorf("failed to read %s: %s", name, err)
+		}
+		snapshot.files[name] = content
+	}
+	return snapshot, nil
+}
+
+// diff returns the unified diff of the lockfiles changed since the snapshot, an empty string if none changed.
+func (s lockfileSnapshot) diff() (string, error) {
+	current, err := snapshotLockfiles(s.workDir, s.names)
+	if err != nil {
+		return "", err
+	}
+
+	var patch strings.Builder
+	for _, name := range s.names {
+		before, after := s.files[name], current.files[name]
+		if string(before) == string(after) {
+			continue
+		}
+
+		fileDiff, err := unifiedDiff(name, before, after)
+		if err != nil {
+			return "", err
+		}
+		patch.WriteString(fileDiff)
+	}
+	return patch.String(), nil
+}
+
+// unifiedDiff runs `diff -u` over the two versions of a file, a nil content stands for a missing file.
+func unifiedDiff(name string, before, after []byte) (string, error) {
+	dir, err := os.MkdirTemp("", "lockfile-drift")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	beforePth, afterPth := os.DevNull, os.DevNull
+	if before != nil {
+		beforePth = filepath.Join(dir, "before")
+		if err := os.WriteFile(beforePth, before, 0644); err != nil {
+			return "", fmt.Errorf("failed to write %s snapshot: %s", name, err)
+		}
+	}
+	if after != nil {
+		afterPth = filepath.Join(dir, "after")
+		if err := os.WriteFile(afterPth, after, 0644); err != nil {
+			return "", fmt.Errorf("failed to write %s snapshot: %s", name, err)
+		}
+	}
+
+	diffCmd := command.New("diff", "-u", "--label", "a/"+name, "--label", "b/"+name, beforePth, afterPth)
+	out, err := diffCmd.GetCmd().Output()
+	// diff exits with 1 if the files differ
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return "", fmt.Errorf("failed to diff %s: %s", name, err)
+	}
+	return string(out), nil
+}
+
+// exportLockfileDrift writes the lockfile patch to the deploy directory and returns its path.
+func exportLockfileDrift(patch string) (string, error) {
+	deployDir := os.Getenv("BITRISE_DEPLOY_DIR")
+	if deployDir == "" {
+		return "", fmt.Errorf("BITRISE_DEPLOY_DIR is not set")
+	}
+
+	pth := filepath.Join(deployDir, lockfileDriftPatchName)
+	if err := os.WriteFile(pth, []byte(patch), 0644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %s", lockfileDriftPatchName, err)
+	}
+	return pth, nil
+}
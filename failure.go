@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	failureReasonTimeout = "timeout"
+	failureReasonUnknown = "unknown"
+)
+
+// failureCategory is a kind of yarn failure, recognized by patterns of the command output.
+type failureCategory struct {
+	reason      string
+	explanation string
+	remediation string
+	patterns    []*regexp.Regexp
+}
+
+func (c failureCategory) matches(output *outputInspector) bool {
+	for _, pattern := range c.patterns {
+		if output.matches(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// failureCategories are ordered by precedence: the root cause of a failure might lead to more errors in the output,
+// like a full disk causing integrity check failures.
+var failureCategories = []failureCategory{
+	{
+		reason:      "disk_space",
+		explanation: "The machine ran out of disk space.",
+		remediation: "Free up disk space before running yarn (for example by removing unused caches or build artifacts), or use a machine with more storage.",
+		patterns: []*regexp.Regexp{
+			regexp.MustCompile(`ENOSPC\b`),
+			regexp.MustCompile(`No space left on device`),
+		},
+	},
+	{
+		reason:      "registry_auth",
+		explanation: "The package registry rejected the request as unauthenticated or forbidden.",
+		remediation: "Check the registry credentials (`_authToken` in .npmrc, `npmAuthToken` in .yarnrc.yml) and that the token has access to the requested packages. Make sure the environment variables holding the credentials are available in the build.",
+		patterns: []*regexp.Regexp{
+			regexp.MustCompile(`code E40[13]\b`),
+			regexp.MustCompile(`Request failed \\?"40[13]`),
+			regexp.MustCompile(`Response code 40[13]`),
+			regexp.MustCompile(`YN0041\b`),
+		},
+	},
+	{
+		reason:      "network",
+		explanation: "Yarn could not reach the package registry.",
+		remediation: "Check the registry URL and the network access of the machine. Transient errors can be retried with the **Maximum number of attempts** input, slow registries might need a higher `--network-timeout` (recommended value is 100000).",
+		patterns: append(transientFailurePatterns(),
+			regexp.MustCompile(`ENOTFOUND\b`),
+			regexp.MustCompile(`ECONNREFUSED\b`),
+		),
+	},
+	{
+		reason:      "integrity",
+		explanation: "A downloaded package does not match the checksum recorded in the lockfile.",
+		remediation: "The package was republished or the cache is corrupted. Clear the Yarn cache, then regenerate the affected lockfile entries locally and commit the updated yarn.lock.",
+		patterns: []*regexp.Regexp{
+			regexp.MustCompile(`Integrity check failed`),
+			regexp.MustCompile(`EINTEGRITY\b`),
+			regexp.MustCompile(`YN0018\b`),
+			regexp.MustCompile(`doesn't match the expected checksum`),
+		},
+	},
+	{
+		reason:      "lockfile",
+		explanation: "yarn.lock is out of date and the install is not allowed to update it.",
+		remediation: "Run yarn install locally and commit the updated yarn.lock, or set **Lockfile mode** to `update`.",
+		patterns:    lockfileViolationPatterns(),
+	},
+	{
+		reason:      "engine",
+		explanation: "A package is not compatible with the Node.js version in use.",
+		remediation: "Select a Node.js version matching the `engines` field of the package, for example with a .nvmrc file and **Select a matching Node.js version**.",
+		patterns: []*regexp.Regexp{
+			regexp.MustCompile(`The engine "[^"]+" is incompatible with this module`),
+			regexp.MustCompile(`Found incompatible module`),
+			regexp.MustCompile(`This tool requires a Node version compatible with`),
+		},
+	},
+	{
+		reason:      "missing_script",
+		explanation: "The command is neither a yarn command nor a script of package.json.",
+		remediation: "Check the spelling of the command and the scripts defined in package.json.",
+		patterns: []*regexp.Regexp{
+			regexp.MustCompile(`Command "[^"]+" not found`),
+			regexp.MustCompile(`Couldn't find a script named`),
+		},
+	},
+	{
+		reason:      "native_build",
+		explanation: "Building a native module failed.",
+		remediation: "Make sure the build tools required by node-gyp (Python, make and a C++ compiler) are installed, and that the native module supports the Node.js version in use.",
+		patterns: []*regexp.Regexp{
+			regexp.MustCompile(`gyp ERR!`),
+			regexp.MustCompile(`node-pre-gyp ERR!`),
+			regexp.MustCompile(`YN0009\b`),
+		},
+	},
+	{
+		reason:      "peer_dependency",
+		explanation: "The dependencies have conflicting peer dependency requirements.",
+		remediation: "Align the versions of the packages with conflicting peer dependencies in package.json, then update yarn.lock locally.",
+		patterns: []*regexp.Regexp{
+			regexp.MustCompile(`ERESOLVE\b`),
+			regexp.MustCompile(`YN0060\b`),
+			regexp.MustCompile(`has unmet peer dependency`),
+			regexp.MustCompile(`has incorrect peer dependency`),
+		},
+	},
+}
+
+func transientFailurePatterns() []*regexp.Regexp {
+	var patterns []*regexp.Regexp
+	for _, failure := range transientFailures {
+		patterns = append(patterns, failure.pattern)
+	}
+	return patterns
+}
+
+func lockfileViolationPatterns() []*regexp.Regexp {
+	var patterns []*regexp.Regexp
+	for _, message := range lockfileViolationMessages {
+		patterns = append(patterns, regexp.MustCompile(regexp.QuoteMeta(message)))
+	}
+	return patterns
+}
+
+// classifyFailure returns the category of a failed yarn command based on its output, nil if it is not recognized.
+func classifyFailure(output *outputInspector) *failureCategory {
+	for i := range failureCategories {
+		if failureCategories[i].matches(output) {
+			return &failureCategories[i]
+		}
+	}
+	return nil
+}
+
+// commandFailure is a failed yarn command along with the category of the failure.
+type commandFailure struct {
+	reason string
+	err    error
+}
+
+func (f *commandFailure) Error() string {
+	return f.err.Error()
+}
+
+func (f *commandFailure) Unwrap() error {
+	return f.err
+}
+
+func printFailureDiagnostics(category *failureCategory) {
+	fmt.Println()
+	log.Warnf("%s", category.explanation)
+	log.Warnf("%s", category.remediation)
+}
+
+// failureReason returns the category of the failure reported by the error.
+func failureReason(err error) string {
+	var failure *commandFailure
+	if errors.As(err, &failure) {
+		return failure.reason
+	}
+	return failureReasonUnknown
+}
+
+func exportFailureReason(err error) {
+	exportOutput("YARN_FAILURE_REASON", failureReason(err))
+}
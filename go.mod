@@ -3,7 +3,9 @@ module github.com/bitrise-steplib/steps-yarn
 go 1.17
 
 require (
+	github.com/Masterminds/semver/v3 v3.1.1
 	github.com/bitrise-io/go-steputils v1.0.2
 	github.com/bitrise-io/go-utils v1.0.1
 	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/errorutil"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// yarnExecutable is the program (and its leading arguments) invoking Yarn.
+type yarnExecutable struct {
+	name string
+	args []string
+	envs []string
+}
+
+var globalYarn = yarnExecutable{name: "yarn"}
+
+func (e yarnExecutable) command(args ...string) *command.Model {
+	cmd := command.New(e.name, append(append([]string{}, e.args...), args...)...)
+	if len(e.envs) > 0 {
+		cmd.AppendEnvs(e.envs...)
+	}
+	return cmd
+}
+
+// withNode returns the executable running Yarn with the Node.js installation of the given directory
+// instead of the one on the PATH.
+func (e yarnExecutable) withNode(nodeBinDir string) yarnExecutable {
+	if nodeBinDir == "" {
+		return e
+	}
+	// exec looks up the program on the PATH of the step, not on the PATH passed to the command
+	if e.name == "node" {
+		e.name = filepath.Join(nodeBinDir, "node")
+	}
+	e.envs = append(append([]string{}, e.envs...), nodePathEnv(nodeBinDir))
+	return e
+}
+
+// nodePath returns the Node.js binary running Yarn.
+func (e yarnExecutable) nodePath(nodeBinDir string) string {
+	if filepath.Base(e.name) == "node" {
+		return e.name
+	}
+	if nodeBinDir != "" {
+		return filepath.Join(nodeBinDir, "node")
+	}
+	return "node"
+}
+
+// nodePathEnv returns the PATH environment variable putting the Node.js installation of the given directory first.
+func nodePathEnv(nodeBinDir string) string {
+	return "PATH=" + nodeBinDir + string(os.PathListSeparator) + os.Getenv("PATH")
+}
+
+// nodeToolPath returns the program (npm, Corepack or a global yarn) of the Node.js installation of the given directory
+// if it has one, otherwise the name to look up on the PATH.
+func nodeToolPath(nodeBinDir, name string) string {
+	if nodeBinDir != "" {
+		pth := filepath.Join(nodeBinDir, name)
+		if _, err := os.Stat(pth); err == nil {
+			return pth
+		}
+	}
+	return name
+}
+
+// nodeToolCommand returns the command running a program shipped with Node.js with the Node.js installation
+// of the given directory.
+func nodeToolCommand(nodeBinDir, name string, args ...string) *command.Model {
+	cmd := command.New(nodeToolPath(nodeBinDir, name), args...)
+	if nodeBinDir != "" {
+		cmd.AppendEnvs(nodePathEnv(nodeBinDir))
+	}
+	return cmd
+}
+
+// setupYarn makes sure a Yarn matching the requirement is available in the working directory.
+// The returned executable runs Yarn with the Node.js installation of nodeBinDir, if it is set.
+func setupYarn(workDir, nodeBinDir string, requirement *yarnRequirement, toolCache yarnToolCache, installers []yarnInstaller) (yarnExecutable, *semver.Version, error) {
+	release, err := findCheckedInYarnRelease(workDir)
+	if err != nil {
+		return yarnExecutable{}, nil, err
+	}
+	if release != nil {
+		return useCheckedInYarnRelease(workDir, nodeBinDir, *release, requirement)
+	}
+
+	if yarn, version, ok := validateYarnInstallation(workDir, nodeBinDir, requirement); ok {
+		return yarn.withNode(nodeBinDir), version, nil
+	}
+
+	if yarn, version, ok := toolCache.lookup(requirement); ok {
+		log.Infof("Using Yarn %s from the tool cache", version)
+		log.Printf("Yarn binary: %s", yarn.args[0])
+		return yarn.withNode(nodeBinDir), version, nil
+	}
+
+	installVersion := ""
+	if requirement != nil {
+		if installVersion, err = resolveYarnVersion(requirement, nodeBinDir); err != nil {
+			// Air-gapped machines can not list the released versions, a pre-staged release might still match
+			log.Warnf("Failed to resolve Yarn %s: %s", requirement, err)
+			log.Warnf("Trying the installers accepting any version")
+			installVersion = ""
+		}
+	}
+	yarn, err := installYarn(installers, workDir, installVersion, func(yarn yarnExecutable) error {
+		version, err := getYarnVersion(yarn, nodeBinDir, workDir)
+		if err != nil {
+			return err
+		}
+		if !requirement.isSatisfiedBy(version) {
+			return fmt.Errorf("installed Yarn %s does not match the required version %s", version, requirement)
+		}
+		return nil
+	})
+	if err != nil {
+		return yarnExecutable{}, nil, err
+	}
+	if err := printYarnVersion(yarn.withNode(nodeBinDir), workDir); err != nil {
+		return yarnExecutable{}, nil, err
+	}
+
+	version, err := getYarnVersion(yarn, nodeBinDir, workDir)
+	if err != nil {
+		return yarnExecutable{}, nil, err
+	}
+	return yarn.withNode(nodeBinDir), version, nil
+}
+
+// useCheckedInYarnRelease runs the release committed to the repository directly with node,
+// so no global Yarn installation is needed.
+func useCheckedInYarnRelease(workDir, nodeBinDir string, release yarnRelease, requirement *yarnRequirement) (yarnExecutable, *semver.Version, error) {
+	yarn := yarnExecutable{name: "node", args: []string{release.path}}
+
+	version, err := getYarnVersion(yarn, nodeBinDir, workDir)
+	if err != nil {
+		return yarnExecutable{}, nil, err
+	}
+	if !requirement.isSatisfiedBy(version) {
+		return yarnExecutable{}, nil, fmt.Errorf("the Yarn release referenced by %s (%s) does not match the required version %s", release.source, version, requirement)
+	}
+
+	log.Infof("Using the Yarn release checked in to the repository, skipping Yarn installation")
+	log.Printf("Yarn binary: %s (referenced by %s)", release.path, release.source)
+	log.Printf("Yarn version: %s", version)
+
+	return yarn.withNode(nodeBinDir), version, nil
+}
+
+// validateYarnInstallation checks the yarn of the Node.js installation of nodeBinDir or the one on the PATH.
+func validateYarnInstallation(workDir, nodeBinDir string, requirement *yarnRequirement) (yarnExecutable, *semver.Version, bool) {
+	yarn := yarnExecutable{name: nodeToolPath(nodeBinDir, "yarn")}
+	pth, err := exec.LookPath(yarn.name)
+	if err != nil {
+		log.Debugf("yarn is not installed to the PATH")
+		return yarnExecutable{}, nil, false
+	}
+
+	version, err := getYarnVersion(yarn, nodeBinDir, workDir)
+	if err != nil {
+		log.Debugf("%s", err)
+		return yarnExecutable{}, nil, false
+	}
+
+	if !requirement.isSatisfiedBy(version) {
+		log.Warnf("Yarn %s is installed at %s, but %s is required", version, pth, requirement)
+		return yarnExecutable{}, nil, false
+	}
+
+	log.Infof("Yarn is already installed at: %s", pth)
+	fmt.Println()
+	log.Infof("Yarn version:")
+	log.Printf(version.String())
+
+	return yarn, version, true
+}
+
+func printYarnVersion(yarn yarnExecutable, workDir string) error {
+	log.Infof("Yarn version:")
+	versionCmd := yarn.command("--version")
+	versionCmd.SetStdout(os.Stdout).SetStderr(os.Stderr).SetDir(workDir)
+
+	fmt.Println()
+	log.Donef("$ %s", versionCmd.PrintableCommandArgs())
+	fmt.Println()
+	if err := versionCmd.Run(); err != nil {
+		if errorutil.IsExitStatusError(err) {
+			return fmt.Errorf("yarn version command failed: %s", err)
+		}
+		return fmt.Errorf("failed to run command: %s", err)
+	}
+
+	return nil
+}
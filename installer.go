@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/errorutil"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// yarnInstaller is a strategy to provision Yarn.
+// install returns a skipError if the strategy can not be used on the current machine or for the requested version.
+type yarnInstaller interface {
+	name() string
+	install(workDir, version string) (yarnExecutable, error)
+}
+
+type skipError struct {
+	reason string
+}
+
+func (e skipError) Error() string {
+	return e.reason
+}
+
+func skipf(format string, v ...interface{}) error {
+	return skipError{reason: fmt.Sprintf(format, v...)}
+}
+
+// newYarnInstallers returns the installer chain in order of preference.
+// npm and Corepack are run from the Node.js installation of nodeBinDir, if it is set.
+func newYarnInstallers(toolCache yarnToolCache, releasePath, nodeBinDir string) []yarnInstaller {
+	return []yarnInstaller{
+		corepackInstaller{nodeBinDir: nodeBinDir},
+		npmInstaller{nodeBinDir: nodeBinDir},
+		// Yarn Berry releases can only be downloaded into the tool cache if Corepack is not available
+		toolCacheInstaller{cache: toolCache, nodeBinDir: nodeBinDir},
+		localReleaseInstaller{path: releasePath},
+		homebrewInstaller{},
+	}
+}
+
+// installYarn tries the installers one after the other until one of them installs a Yarn accepted by verify.
+// An empty version means any Yarn release is accepted by the installers.
+func installYarn(installers []yarnInstaller, workDir, version string, verify func(yarnExecutable) error) (yarnExecutable, error) {
+	if version == "" {
+		log.Infof("Yarn not installed. Installing...")
+	} else {
+		log.Infof("Yarn not installed. Installing Yarn %s...", version)
+	}
+
+	var failures []string
+	for _, installer := range installers {
+		yarn, err := installer.install(workDir, version)
+		if err == nil {
+			err = verify(yarn)
+		}
+		if err == nil {
+			log.Donef("Installed Yarn with %s", installer.name())
+			return yarn, nil
+		}
+
+		var skipped skipError
+		if errors.As(err, &skipped) {
+			log.Printf("Skipping %s installer: %s", installer.name(), err)
+		} else {
+			log.Warnf("Installing Yarn with %s failed: %s", installer.name(), err)
+		}
+		failures = append(failures, fmt.Sprintf("- %s: %s", installer.name(), err))
+	}
+
+	return yarnExecutable{}, fmt.Errorf("none of the installers could install Yarn:\n%s", strings.Join(failures, "\n"))
+}
+
+func isYarnClassic(version string) bool {
+	return version == "" || strings.HasPrefix(version, "1.")
+}
+
+type corepackInstaller struct {
+	nodeBinDir string
+}
+
+func (corepackInstaller) name() string {
+	return "Corepack"
+}
+
+func (i corepackInstaller) install(workDir, version string) (yarnExecutable, error) {
+	if version == "" {
+		return yarnExecutable{}, skipf("no Yarn version requested")
+	}
+	if _, err := exec.LookPath(nodeToolPath(i.nodeBinDir, "corepack")); err != nil {
+		return yarnExecutable{}, skipf("corepack is not available")
+	}
+
+	for _, cmd := range getCorepackCommands(version, i.nodeBinDir) {
+		if err := runInstallCommand(cmd.SetDir(workDir)); err != nil {
+			return yarnExecutable{}, err
+		}
+	}
+	// Corepack enables its yarn shim next to the corepack binary
+	return yarnExecutable{name: nodeToolPath(i.nodeBinDir, "yarn")}, nil
+}
+
+func getCorepackCommands(version, nodeBinDir string) []*command.Model {
+	return []*command.Model{
+		nodeToolCommand(nodeBinDir, "corepack", "enable"),
+		nodeToolCommand(nodeBinDir, "corepack", "prepare", "yarn@"+version, "--activate"),
+	}
+}
+
+type npmInstaller struct {
+	nodeBinDir string
+}
+
+func (npmInstaller) name() string {
+	return "npm"
+}
+
+func (i npmInstaller) install(_, version string) (yarnExecutable, error) {
+	// The yarn npm package only ships Yarn classic (1.x) releases
+	if !isYarnClassic(version) {
+		return yarnExecutable{}, skipf("npm can only install Yarn classic")
+	}
+	if _, err := exec.LookPath(nodeToolPath(i.nodeBinDir, "npm")); err != nil {
+		return yarnExecutable{}, skipf("npm is not available")
+	}
+
+	if err := runInstallCommand(getInstallYarnCommand(version, i.nodeBinDir)); err != nil {
+		return yarnExecutable{}, err
+	}
+	// The global packages of a Node.js installation are linked next to its node binary
+	return yarnExecutable{name: nodeToolPath(i.nodeBinDir, "yarn")}, nil
+}
+
+func getInstallYarnCommand(version, nodeBinDir string) *command.Model {
+	pkg := "yarn"
+	if version != "" {
+		pkg = "yarn@" + version
+	}
+	return nodeToolCommand(nodeBinDir, "npm", "install", "--global", pkg)
+}
+
+// localReleaseInstaller uses a pre-staged Yarn release: a standalone .js/.cjs file or a release tarball.
+type localReleaseInstaller struct {
+	path string
+}
+
+func (localReleaseInstaller) name() string {
+	return "local release"
+}
+
+func (i localReleaseInstaller) install(_, _ string) (yarnExecutable, error) {
+	if i.path == "" {
+		return yarnExecutable{}, skipf("no local Yarn release provided")
+	}
+	if _, err := os.Stat(i.path); err != nil {
+		return yarnExecutable{}, fmt.Errorf("local Yarn release not found: %s", err)
+	}
+
+	if strings.HasSuffix(i.path, ".tgz") || strings.HasSuffix(i.path, ".tar.gz") {
+		dir, err := os.MkdirTemp("", "yarn-release")
+		if err != nil {
+			return yarnExecutable{}, fmt.Errorf("failed to create temporary directory: %s", err)
+		}
+		entrypoint, err := extractYarnTarball(i.path, dir)
+		if err != nil {
+			return yarnExecutable{}, err
+		}
+		return yarnExecutable{name: "node", args: []string{entrypoint}}, nil
+	}
+	if strings.HasSuffix(i.path, ".js") || strings.HasSuffix(i.path, ".cjs") {
+		return yarnExecutable{name: "node", args: []string{i.path}}, nil
+	}
+	return yarnExecutable{}, fmt.Errorf("unsupported local Yarn release (expected a .tgz, .tar.gz, .js or .cjs file): %s", i.path)
+}
+
+// extractYarnTarball extracts a Yarn release tarball (a GitHub release `yarn-vX.Y.Z.tar.gz` or an npm `yarn-X.Y.Z.tgz`)
+// into dir and returns the path of its entrypoint.
+func extractYarnTarball(pth, dir string) (string, error) {
+	if err := runInstallCommand(command.New("tar", "-xzf", pth, "-C", dir)); err != nil {
+		return "", err
+	}
+	return findYarnEntrypoint(dir)
+}
+
+// findYarnEntrypoint returns the bin/yarn.js (or bin/yarn.cjs) of an extracted Yarn release tarball.
+func findYarnEntrypoint(dir string) (string, error) {
+	for _, pattern := range []string{"*/bin/yarn.js", "*/bin/yarn.cjs"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return "", err
+		}
+		if len(matches) > 0 {
+			return matches[0], nil
+		}
+	}
+	return "", fmt.Errorf("no bin/yarn.js found in %s", dir)
+}
+
+type homebrewInstaller struct{}
+
+func (homebrewInstaller) name() string {
+	return "Homebrew"
+}
+
+func (homebrewInstaller) install(_, version string) (yarnExecutable, error) {
+	// The Homebrew formula only ships the latest Yarn classic release
+	if version != "" {
+		return yarnExecutable{}, skipf("Homebrew can not install a specific Yarn version")
+	}
+	if _, err := exec.LookPath("brew"); err != nil {
+		return yarnExecutable{}, skipf("brew is not available")
+	}
+
+	if err := runInstallCommand(command.New("brew", "install", "yarn")); err != nil {
+		return yarnExecutable{}, err
+	}
+	return globalYarn, nil
+}
+
+func runInstallCommand(installCmd *command.Model) error {
+	fmt.Println()
+	log.Donef("$ %s", installCmd.PrintableCommandArgs())
+	fmt.Println()
+
+	if err := installCmd.Run(); err != nil {
+		if errorutil.IsExitStatusError(err) {
+			return fmt.Errorf("installing yarn failed: %s", err)
+		}
+		return fmt.Errorf("failed to run command: %s", err)
+	}
+
+	return nil
+}
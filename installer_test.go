@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeInstaller records its calls and returns the configured result.
+type fakeInstaller struct {
+	installerName string
+	yarn          yarnExecutable
+	err           error
+	calls         *[]string
+}
+
+func (i fakeInstaller) name() string {
+	return i.installerName
+}
+
+func (i fakeInstaller) install(_, version string) (yarnExecutable, error) {
+	*i.calls = append(*i.calls, fmt.Sprintf("%s@%s", i.installerName, version))
+	return i.yarn, i.err
+}
+
+func acceptAll(yarnExecutable) error {
+	return nil
+}
+
+func TestInstallYarn(t *testing.T) {
+	tests := []struct {
+		name       string
+		installers func(calls *[]string) []yarnInstaller
+		verify     func(yarnExecutable) error
+		want       string
+		wantCalls  []string
+		wantErr    []string
+	}{
+		{
+			name: "first succeeding installer wins",
+			installers: func(calls *[]string) []yarnInstaller {
+				return []yarnInstaller{
+					fakeInstaller{installerName: "first", yarn: yarnExecutable{name: "first"}, calls: calls},
+					fakeInstaller{installerName: "second", yarn: yarnExecutable{name: "second"}, calls: calls},
+				}
+			},
+			verify:    acceptAll,
+			want:      "first",
+			wantCalls: []string{"first@1.22.19"},
+		},
+		{
+			name: "skipped and failing installers fall through",
+			installers: func(calls *[]string) []yarnInstaller {
+				return []yarnInstaller{
+					fakeInstaller{installerName: "skipped", err: skipf("not available"), calls: calls},
+					fakeInstaller{installerName: "failing", err: errors.New("network error"), calls: calls},
+					fakeInstaller{installerName: "working", yarn: yarnExecutable{name: "working"}, calls: calls},
+				}
+			},
+			verify:    acceptAll,
+			want:      "working",
+			wantCalls: []string{"skipped@1.22.19", "failing@1.22.19", "working@1.22.19"},
+		},
+		{
+			name: "installs rejected by verify fall through",
+			installers: func(calls *[]string) []yarnInstaller {
+				return []yarnInstaller{
+					fakeInstaller{installerName: "wrong", yarn: yarnExecutable{name: "wrong"}, calls: calls},
+					fakeInstaller{installerName: "right", yarn: yarnExecutable{name: "right"}, calls: calls},
+				}
+			},
+			verify: func(yarn yarnExecutable) error {
+				if yarn.name != "right" {
+					return errors.New("version mismatch")
+				}
+				return nil
+			},
+			want:      "right",
+			wantCalls: []string{"wrong@1.22.19", "right@1.22.19"},
+		},
+		{
+			name: "all installers failing",
+			installers: func(calls *[]string) []yarnInstaller {
+				return []yarnInstaller{
+					fakeInstaller{installerName: "skipped", err: skipf("not available"), calls: calls},
+					fakeInstaller{installerName: "failing", err: errors.New("network error"), calls: calls},
+				}
+			},
+			verify:    acceptAll,
+			wantCalls: []string{"skipped@1.22.19", "failing@1.22.19"},
+			wantErr:   []string{"- skipped: not available", "- failing: network error"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			yarn, err := installYarn(tt.installers(&calls), "", "1.22.19", tt.verify)
+
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("calls: got %v, want %v", calls, tt.wantCalls)
+			}
+			if tt.wantErr != nil {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				for _, want := range tt.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error %q does not contain %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if yarn.name != tt.want {
+				t.Errorf("got %s, want %s", yarn.name, tt.want)
+			}
+		})
+	}
+}
+
+func TestNpmInstallerWithSelectedNode(t *testing.T) {
+	nodeBinDir := t.TempDir()
+	// The fake npm links the installed yarn next to itself, like the global prefix of a Node.js installation
+	npm := "#!/bin/sh\nprintf '#!/bin/sh\\necho 1.22.19\\n' > \"$(dirname \"$0\")/yarn\"\nchmod +x \"$(dirname \"$0\")/yarn\"\n"
+	if err := os.WriteFile(filepath.Join(nodeBinDir, "npm"), []byte(npm), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	yarn, err := npmInstaller{nodeBinDir: nodeBinDir}.install("", "1.22.19")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := filepath.Join(nodeBinDir, "yarn"); yarn.name != want {
+		t.Errorf("got %s, want %s", yarn.name, want)
+	}
+
+	version, err := getYarnVersion(yarn, nodeBinDir, t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if version.String() != "1.22.19" {
+		t.Errorf("got version %s, want 1.22.19", version)
+	}
+}
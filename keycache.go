@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// keyCache restores and saves the dependencies of the project as an archive stored by a key computed from the project.
+type keyCache struct {
+	storage     cacheStorage
+	workDir     string
+	key         string
+	restoreKeys []string
+	paths       []string
+	restoredKey string
+}
+
+// newKeyCache evaluates the cache key templates, like `yarn-{{ os }}-{{ checksum "yarn.lock" }}`.
+func newKeyCache(storage cacheStorage, workDir, keyTemplate string, restoreKeyTemplates, paths []string) (*keyCache, error) {
+	key, err := evaluateCacheKey(keyTemplate, workDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var restoreKeys []string
+	for _, restoreKeyTemplate := range restoreKeyTemplates {
+		restoreKey, err := evaluateCacheKey(restoreKeyTemplate, workDir)
+		if err != nil {
+			return nil, err
+		}
+		restoreKeys = append(restoreKeys, restoreKey)
+	}
+
+	for _, pth := range paths {
+		if filepath.IsAbs(pth) || strings.HasPrefix(filepath.Clean(pth), "..") {
+			return nil, fmt.Errorf("cached path (%s) is not inside the working directory", pth)
+		}
+	}
+
+	return &keyCache{storage: storage, workDir: workDir, key: key, restoreKeys: restoreKeys, paths: paths}, nil
+}
+
+// evaluateCacheKey evaluates a cache key template. Available functions:
+// os, arch, getenv "NAME" and checksum "path" (a sha256 of the files matching the globs, relative to the working directory).
+func evaluateCacheKey(keyTemplate, workDir string) (string, error) {
+	funcs := template.FuncMap{
+		"os":     func() string { return runtime.GOOS },
+		"arch":   func() string { return runtime.GOARCH },
+		"getenv": os.Getenv,
+		"checksum": func(patterns ...string) (string, error) {
+			return checksumFiles(workDir, patterns)
+		},
+	}
+
+	tmpl, err := template.New("key").Funcs(funcs).Parse(keyTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid cache key (%s): %s", keyTemplate, err)
+	}
+
+	var key strings.Builder
+	if err := tmpl.Execute(&key, nil); err != nil {
+		return "", fmt.Errorf("failed to evaluate cache key (%s): %s", keyTemplate, err)
+	}
+	return strings.TrimSpace(key.String()), nil
+}
+
+// checksumFiles returns the sha256 of the content of the files matching the glob patterns, in path order.
+func checksumFiles(workDir string, patterns []string) (string, error) {
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(workDir, pattern))
+		if err != nil {
+			return "", fmt.Errorf("invalid checksum pattern (%s): %s", pattern, err)
+		}
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("no files match %s", strings.Join(patterns, ", "))
+	}
+	sort.Strings(files)
+
+	hash := sha256.New()
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %s", file, err)
+		}
+		_, err = io.Copy(hash, f)
+		_ = f.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %s", file, err)
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// restore extracts the archive of the first matching key into the working directory.
+func (c *keyCache) restore() error {
+	dir, err := os.MkdirTemp("", "yarn-cache-restore")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	start := time.Now()
+	archive := filepath.Join(dir, "cache"+cacheArchiveExt)
+	restoredKey, err := c.storage.restore(append([]string{c.key}, c.restoreKeys...), archive)
+	if err != nil {
+		return err
+	}
+	if restoredKey == "" {
+		log.Printf("No cache found for key: %s", c.key)
+		return nil
+	}
+
+	out, err := command.New("tar", "-xzf", archive, "-C", c.workDir).RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to extract cache archive: %s, out: %s", err, out)
+	}
+
+	c.restoredKey = restoredKey
+	log.Donef("Cache restored from key %s in %s", restoredKey, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// save archives the cached paths and stores them with the cache key, unless the cache was restored with the same key.
+func (c *keyCache) save() error {
+	if c.restoredKey == c.key {
+		log.Printf("Cache was restored with the same key (%s), skipping save", c.key)
+		return nil
+	}
+
+	var paths []string
+	for _, pth := range c.paths {
+		if _, err := os.Stat(filepath.Join(c.workDir, pth)); err == nil {
+			paths = append(paths, pth)
+		}
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("none of the cached paths exist: %s", strings.Join(c.paths, ", "))
+	}
+
+	dir, err := os.MkdirTemp("", "yarn-cache-save")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	start := time.Now()
+	archive := filepath.Join(dir, "cache"+cacheArchiveExt)
+	out, err := command.New("tar", append([]string{"-czf", archive, "-C", c.workDir}, paths...)...).RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to create cache archive: %s, out: %s", err, out)
+	}
+
+	if err := c.storage.save(c.key, archive); err != nil {
+		return err
+	}
+	log.Donef("Cache saved with key %s in %s", c.key, time.Since(start).Round(time.Millisecond))
+	return nil
+}
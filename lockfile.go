@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const yarnLockFile = "yarn.lock"
+
+const (
+	lockfileModeFrozen = "frozen"
+	lockfileModeUpdate = "update"
+	lockfileModeAuto   = "auto"
+)
+
+var lockfileViolationMessages = []string{
+	// Yarn classic
+	"Your lockfile needs to be updated",
+	// Yarn Berry (YN0028)
+	"The lockfile would have been modified by this install, which is explicitly forbidden",
+}
+
+// lockfileEnforcement returns the flags and environment variables applying the lockfile mode to an install.
+// The update mode leaves the defaults of Yarn in effect.
+// Yarn classic is configured with --frozen-lockfile, Yarn Berry with its enableImmutableInstalls setting,
+// as the latter also applies to the commands replacing install (like `workspaces focus`).
+func lockfileEnforcement(mode string, yarnMajor uint64, workDir string) ([]string, []string) {
+	frozen := mode == lockfileModeFrozen
+	if mode == lockfileModeAuto {
+		_, err := os.Stat(filepath.Join(workDir, yarnLockFile))
+		frozen = err == nil
+		if frozen {
+			log.Printf("%s found, installing with a frozen lockfile", yarnLockFile)
+		}
+	}
+
+	if yarnMajor >= 2 {
+		switch {
+		case frozen:
+			return nil, []string{"YARN_ENABLE_IMMUTABLE_INSTALLS=true"}
+		case mode == lockfileModeAuto:
+			// Yarn Berry enables immutable installs by default on CI, which would fail the install creating the lockfile
+			return nil, []string{"YARN_ENABLE_IMMUTABLE_INSTALLS=false"}
+		}
+		return nil, nil
+	}
+
+	if frozen {
+		return []string{"--frozen-lockfile"}, nil
+	}
+	return nil, nil
+}
+
+// staleLockfileEntries returns the package.json dependencies missing from yarn.lock.
+func staleLockfileEntries(workDir string, pkg packageJSON) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join(workDir, yarnLockFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", yarnLockFile, err)
+	}
+	descriptors := parseLockfileDescriptors(string(content))
+
+	var stale []string
+	for _, group := range []struct {
+		name         string
+		dependencies map[string]string
+	}{
+		{"dependencies", pkg.Dependencies},
+		{"devDependencies", pkg.DevDependencies},
+		{"optionalDependencies", pkg.OptionalDependencies},
+	} {
+		for name, version := range group.dependencies {
+			descriptor := name + "@" + version
+			// Yarn Berry prefixes semver ranges with the default npm: protocol
+			if descriptors[descriptor] || descriptors[name+"@npm:"+version] {
+				continue
+			}
+			stale = append(stale, fmt.Sprintf("%s (%s)", descriptor, group.name))
+		}
+	}
+	sort.Strings(stale)
+	return stale, nil
+}
+
+// parseLockfileDescriptors returns the dependency descriptors (like `lodash@^4.17.21`) resolved by a
+// Yarn classic or Yarn Berry lockfile.
+func parseLockfileDescriptors(content string) map[string]bool {
+	descriptors := map[string]bool{}
+	for _, line := range strings.Split(content, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, " ") || !strings.HasSuffix(line, ":") {
+			continue
+		}
+
+		for _, descriptor := range strings.Split(strings.TrimSuffix(line, ":"), ",") {
+			descriptor = strings.Trim(strings.TrimSpace(descriptor), `"`)
+			if descriptor != "" {
+				descriptors[descriptor] = true
+			}
+		}
+	}
+	return descriptors
+}
+
+func printStaleLockfileEntries(workDir string, pkg packageJSON) {
+	stale, err := staleLockfileEntries(workDir, pkg)
+	if err != nil {
+		log.Warnf("Failed to check %s: %s", yarnLockFile, err)
+		return
+	}
+
+	fmt.Println()
+	if len(stale) == 0 {
+		log.Warnf("%s is out of date, run yarn install locally and commit the updated %s.", yarnLockFile, yarnLockFile)
+		return
+	}
+	log.Warnf("%s is out of date, the following package.json entries are missing from it:", yarnLockFile)
+	for _, entry := range stale {
+		log.Warnf("- %s", entry)
+	}
+	log.Warnf("Run yarn install locally and commit the updated %s.", yarnLockFile)
+}
@@ -1,18 +1,16 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/bitrise-io/go-steputils/cache"
 	"github.com/bitrise-io/go-steputils/stepconf"
-	"github.com/bitrise-io/go-utils/command"
-	"github.com/bitrise-io/go-utils/errorutil"
+	"github.com/bitrise-io/go-utils/colorstring"
 	"github.com/bitrise-io/go-utils/log"
 	"github.com/kballard/go-shellquote"
 )
@@ -21,8 +19,43 @@ type config struct {
 	WorkingDir  string `env:"workdir,dir"`
 	YarnCommand string `env:"command"`
 	YarnArgs    string `env:"args"`
-	UseCache    bool   `env:"cache_local_deps,opt[yes,no]"`
+	Commands    string `env:"commands"`
+	KeepGoing   bool   `env:"continue_on_error,opt[yes,no]"`
+
+	RetryAttempts       int  `env:"retry_max_attempts,range[1..10]"`
+	RetryDelay          int  `env:"retry_initial_delay,range[0..300]"`
+	RetryJitter         bool `env:"retry_jitter,opt[yes,no]"`
+	RetryNetworkTimeout bool `env:"retry_raise_network_timeout,opt[yes,no]"`
+
+	Timeout         int    `env:"timeout"`
+	NoOutputTimeout int    `env:"no_output_timeout"`
+	SaveLog         bool   `env:"save_log,opt[yes,no]"`
+	SecretEnvs      string `env:"secret_env_vars"`
+	AddBinToPath    bool   `env:"add_bin_to_path,opt[yes,no]"`
+
+	InWorkspaces     bool   `env:"run_in_workspaces,opt[yes,no]"`
+	WorkspaceInclude string `env:"workspace_include"`
+	WorkspaceExclude string `env:"workspace_exclude"`
+
+	YarnVersion string `env:"yarn_version"`
+	ReleasePath string `env:"yarn_release_path"`
+	ToolCache   string `env:"yarn_tool_cache_dir"`
+	Lockfile    string `env:"lockfile_mode,opt[frozen,update,auto]"`
+	FailOnDrift bool   `env:"fail_on_lockfile_drift,opt[yes,no]"`
 	IsDebugLog  bool   `env:"verbose_log,opt[yes,no]"`
+
+	UseCache          bool   `env:"cache_local_deps,opt[yes,no]"`
+	CachePackageCache bool   `env:"cache_package_cache,opt[yes,no]"`
+	CacheSkipDirs     string `env:"cache_skip_dirs"`
+	CacheExcludePaths string `env:"cache_exclude_paths"`
+
+	CacheKey         string `env:"cache_key"`
+	CacheRestoreKeys string `env:"cache_restore_keys"`
+	CachePaths       string `env:"cache_paths"`
+	CacheDir         string `env:"cache_local_dir"`
+
+	SelectNodeVersion bool   `env:"select_node_version,opt[yes,no]"`
+	NodeToolDir       string `env:"node_tool_dir"`
 }
 
 func main() {
@@ -30,15 +63,22 @@ func main() {
 	if err := stepconf.Parse(&config); err != nil {
 		failf("Process config: %s", err)
 	}
-	stepconf.Print(config)
-	fmt.Println()
-	log.SetEnableDebugLog(config.IsDebugLog)
 
 	absWorkingDir, err := filepath.Abs(config.WorkingDir)
 	if err != nil {
 		failf("Process config: failed to normalize working directory: %s", err)
 	}
 
+	// The inputs can contain secrets, e.g. tokens passed in the args
+	redactor := newRedactor(absWorkingDir, splitPatterns(config.SecretEnvs))
+	printConfig(config, redactor)
+	fmt.Println()
+	log.SetEnableDebugLog(config.IsDebugLog)
+
+	if config.Timeout < 0 || config.NoOutputTimeout < 0 {
+		failf("Process config: timeouts can not be negative")
+	}
+
 	commandParams, err := shellquote.Split(config.YarnCommand)
 	if err != nil {
 		failf("Process config: provided yarn command is not a valid CLI command: %s", err)
@@ -49,138 +89,292 @@ func main() {
 		failf("Process config: provided yarn arguments are not valid CLI arguments: %s", err)
 	}
 
-	validInstallation := validateYarnInstallation(absWorkingDir)
-	if !validInstallation {
-		if err := installYarn(); err != nil {
-			failf("Install dependencies: %s", err)
+	var commandLines [][]string
+	if config.Commands != "" {
+		if commandLines, err = parseCommands(config.Commands); err != nil {
+			failf("Process config: provided yarn commands are not valid: %s", err)
 		}
-		if err := printYarnVersion(absWorkingDir); err != nil {
-			failf("Install dependencies: %s", err)
+		if len(commandParams) > 0 || len(args) > 0 {
+			log.Warnf("The commands input is set, ignoring the command and args inputs")
 		}
 	}
 
-	yarnCmd := command.New("yarn", append(commandParams, args...)...)
-	var output bytes.Buffer
-	yarnCmd.SetDir(absWorkingDir)
-	yarnCmd.SetStdout(io.MultiWriter(os.Stdout, &output)).SetStderr(io.MultiWriter(os.Stderr, &output))
+	pkg, err := readPackageJSON(absWorkingDir)
+	if err != nil {
+		failf("Process config: %s", err)
+	}
+
+	declaredVersion, err := pkg.declaredYarnVersion()
+	if err != nil {
+		failf("Process config: %s", err)
+	}
+	if declaredVersion != "" {
+		log.Infof("package.json requires Yarn %s (packageManager field)", declaredVersion)
+		fmt.Println()
+	}
 
-	fmt.Println()
-	log.Donef("$ %s", yarnCmd.PrintableCommandArgs())
-	fmt.Println()
+	nodeRequirements, err := findNodeRequirements(absWorkingDir, pkg)
+	if err != nil {
+		failf("Process config: %s", err)
+	}
 
-	if err := yarnCmd.Run(); err != nil {
-		if errorutil.IsExitStatusError(err) {
-			if strings.Contains(output.String(), "There appears to be trouble with your network connection. Retrying...") {
-				fmt.Println()
-				log.Warnf(`Looks like you've got network issues while installing yarn.
-	Please try to increase the timeout with --registry https://registry.npmjs.org --network-timeout [NUMBER] command before using this step (recommended value is 100000).
-	If issue still persists, please try to debug the error or reach out to support.`)
-			}
-			failf("Run: provided yarn command failed: %s", err)
+	var nodeBinDir string
+	if len(nodeRequirements) > 0 {
+		if nodeBinDir, err = ensureNodeVersion(nodeRequirements, config.SelectNodeVersion, config.NodeToolDir); err != nil {
+			failf("Check Node.js version: %s", err)
 		}
-		failf("Run: failed to run provided yarn command: %s", err)
+		fmt.Println()
+	}
+
+	requirement, err := getYarnRequirement(config.YarnVersion, declaredVersion)
+	if err != nil {
+		failf("Process config: %s", err)
+	}
+
+	toolCache := yarnToolCache{dir: config.ToolCache}
+	yarn, yarnVersion, err := setupYarn(absWorkingDir, nodeBinDir, requirement, toolCache, newYarnInstallers(toolCache, config.ReleasePath, nodeBinDir))
+	if err != nil {
+		failf("Install dependencies: %s", err)
+	}
+	if err := toolCache.commit(); err != nil {
+		log.Warnf("Failed to cache Yarn releases: %s", err)
 	}
 
-	if config.UseCache && (len(commandParams) == 0 || commandParams[0] == "install") {
-		if err := cacheYarn(absWorkingDir); err != nil {
-			log.Warnf("Failed to cache node_modules: %s", err)
+	if yarn.name != globalYarn.name {
+		if err := exportYarnShim(yarn); err != nil {
+			log.Warnf("Failed to add yarn to the PATH: %s", err)
 		}
 	}
-}
 
-func failf(format string, v ...interface{}) {
-	log.Errorf(format, v...)
-	os.Exit(1)
-}
+	nodeVersion := detectNodeVersion(yarn.nodePath(nodeBinDir))
+	exportOutput("YARN_VERSION", yarnVersion.String())
+	exportOutput("YARN_FLAVOR", yarnFlavor(yarnVersion))
+	exportOutput("NODE_VERSION", nodeVersion)
 
-func getInstallYarnCommand() *command.Model {
-	return command.New("npm", "install", "--global", "yarn")
-}
+	var yarnLog *commandLog
+	if config.SaveLog {
+		if yarnLog, err = createCommandLog(yarnVersion.String(), nodeVersion, absWorkingDir); err != nil {
+			log.Warnf("Failed to create yarn log file: %s", err)
+		}
+	}
 
-func cacheYarn(workingDir string) error {
-	yarnCache := cache.New()
-	var cachePaths []string
+	runner := yarnRunner{
+		yarn:         yarn,
+		yarnVersion:  yarnVersion,
+		workDir:      absWorkingDir,
+		rootDir:      absWorkingDir,
+		pkg:          pkg,
+		lockfileMode: config.Lockfile,
+		retry:        newRetryPolicy(config.RetryAttempts, time.Duration(config.RetryDelay)*time.Second, config.RetryJitter, config.RetryNetworkTimeout),
+		timeouts: commandTimeouts{
+			overall:  time.Duration(config.Timeout) * time.Second,
+			noOutput: time.Duration(config.NoOutputTimeout) * time.Second,
+		},
+		commandLog: yarnLog,
+		redactor:   redactor,
+	}
 
-	// Supporting yarn workspaces (https://yarnpkg.com/lang/en/docs/workspaces/), for this recursively look
-	// up all node_modules directories
-	if err := filepath.Walk(workingDir, func(path string, fileInfo os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	var projectWorkspaces []workspace
+	if len(pkg.Workspaces) > 0 {
+		if projectWorkspaces, err = listWorkspaces(yarn, yarnVersion.Major(), absWorkingDir, pkg); err != nil {
+			log.Warnf("Failed to list workspaces: %s", err)
 		}
-		if fileInfo.IsDir() && fileInfo.Name() == "node_modules" {
-			cachePaths = append(cachePaths, path)
-			return filepath.SkipDir
+	}
+	exportWorkspaces(absWorkingDir, projectWorkspaces)
+
+	var workspaces []workspace
+	if config.InWorkspaces {
+		if workspaces, err = selectWorkspaces(projectWorkspaces, config.WorkspaceInclude, config.WorkspaceExclude); err != nil {
+			failf("Process config: %s", err)
 		}
-		return nil
-	}); err != nil {
-		return fmt.Errorf("failed to find node_modules directories: %s", err)
 	}
 
-	log.Debugf("Cached paths: %s", cachePaths)
-	for _, path := range cachePaths {
-		yarnCache.IncludePath(path)
+	var invocations []yarnInvocation
+	if !config.InWorkspaces {
+		if invocations, err = runner.prepareAll(commandParams, args, commandLines); err != nil {
+			failf("Process config: %s", err)
+		}
 	}
 
-	if err := yarnCache.Commit(); err != nil {
-		return fmt.Errorf("failed to mark node_modules directories to be cached: %s", err)
+	// Computed from the command lines, as the invocations are only prepared per workspace when running in workspaces
+	isInstall := runsInstall(commandParams, args, commandLines)
+
+	var depsCache *keyCache
+	if config.CacheKey != "" && isInstall {
+		storage := localCacheStorage{dir: config.CacheDir}
+		if depsCache, err = newKeyCache(storage, absWorkingDir, config.CacheKey, splitPatterns(config.CacheRestoreKeys), splitPatterns(config.CachePaths)); err != nil {
+			// For example the lockfile of the checksum doesn't exist yet
+			log.Warnf("Skipping key-based caching: %s", err)
+		} else {
+			fmt.Println()
+			log.Infof("Restoring cache")
+			if err := depsCache.restore(); err != nil {
+				log.Warnf("Failed to restore cache: %s", err)
+			} else if depsCache.restoredKey != "" {
+				exportOutput("YARN_CACHE_RESTORED_KEY", depsCache.restoredKey)
+			}
+		}
 	}
-	return nil
-}
 
-func validateYarnInstallation(workDir string) bool {
-	pth, err := exec.LookPath("yarn")
+	lockfiles, err := snapshotLockfiles(absWorkingDir, lockfileNames(yarnVersion.Major()))
 	if err != nil {
-		log.Debugf("yarn is not installed to the PATH")
-		return false
+		log.Warnf("Failed to snapshot lockfiles: %s", err)
 	}
 
-	versionCmd := command.New("yarn", "--version").SetDir(workDir)
-	out, err := versionCmd.RunAndReturnTrimmedCombinedOutput()
-	if err != nil {
-		log.Debugf("yarn version command failed: %s, out: %s", err, out)
-		return false
+	start := time.Now()
+	var runErr error
+	if config.InWorkspaces {
+		runErr = firstWorkspaceFailure(runner.runInWorkspaces(workspaces, commandParams, args, commandLines, config.KeepGoing))
+	} else {
+		runErr = firstFailure(runner.runPipeline(invocations, config.KeepGoing))
+	}
+	duration := time.Since(start)
+	// Closed before failing, so that the log of a failed run is complete
+	if yarnLog != nil {
+		if err := yarnLog.finish(duration, runErr); err != nil {
+			log.Warnf("Failed to close yarn log file: %s", err)
+		}
+	}
+	exportRunOutputs(runErr, duration)
+	exportOutput("NODE_MODULES_BIN_PATH", nodeModulesBinPath(absWorkingDir))
+	if runErr != nil {
+		exportFailureReason(runErr)
+		failf("Run: %s", runErr)
 	}
 
-	log.Infof("Yarn is already installed at: %s", pth)
-	fmt.Println()
-	log.Infof("Yarn version:")
-	log.Printf(out)
+	if config.AddBinToPath && isInstall {
+		addBinToPath(yarn, yarnVersion.Major(), absWorkingDir, nodeBinDir)
+	}
+
+	if err := checkLockfileDrift(lockfiles, config.FailOnDrift); err != nil {
+		failf("Lockfile drift: %s", err)
+	}
+
+	if config.UseCache && isInstall {
+		if err := cacheYarn(absWorkingDir, yarnVersion.Major(), pkg, splitPatterns(config.CacheSkipDirs), splitPatterns(config.CacheExcludePaths)); err != nil {
+			log.Warnf("Failed to cache the installed dependencies: %s", err)
+		}
+	}
+	if config.CachePackageCache && isInstall {
+		if err := cacheYarnPackageCache(yarn, yarnVersion.Major(), absWorkingDir); err != nil {
+			log.Warnf("Failed to cache the Yarn package cache: %s", err)
+		}
+	}
+	if depsCache != nil {
+		fmt.Println()
+		log.Infof("Saving cache")
+		if err := depsCache.save(); err != nil {
+			log.Warnf("Failed to save cache: %s", err)
+		}
+	}
+}
 
-	return true
+// addBinToPath exports the PATH with the directory of the installed executables (and the selected Node.js) prepended,
+// so that the subsequent Steps can call them directly.
+// printConfig prints the inputs in the format of stepconf.Print with the secrets redacted.
+func printConfig(config config, redactor redactor) {
+	value := reflect.ValueOf(config)
+	lines := []string{colorstring.Bluef("Config:")}
+	for i := 0; i < value.NumField(); i++ {
+		key := strings.SplitN(value.Type().Field(i).Tag.Get("env"), ",", 2)[0]
+		fieldValue := fmt.Sprintf("%v", value.Field(i).Interface())
+		if fieldValue == "" {
+			fieldValue = "<unset>"
+		}
+		lines = append(lines, fmt.Sprintf("- %s: %s", key, redactor.redact(fieldValue)))
+	}
+	fmt.Println(strings.Join(lines, "\n"))
 }
 
-func installYarn() error {
-	log.Infof("Yarn not installed. Installing...")
-	installCmd := getInstallYarnCommand()
+func addBinToPath(yarn yarnExecutable, yarnMajor uint64, workDir, nodeBinDir string) {
+	dirs, err := installedBinDirs(yarn, yarnMajor, workDir)
+	if err != nil {
+		log.Warnf("Failed to find the executables of the installed packages: %s", err)
+		return
+	}
+	if len(dirs) == 0 {
+		log.Warnf("No executables of the installed packages found, PATH is not updated")
+		return
+	}
+	if nodeBinDir != "" {
+		dirs = append(dirs, nodeBinDir)
+	}
 
-	fmt.Println()
-	log.Donef("$ %s", installCmd.PrintableCommandArgs())
-	fmt.Println()
+	exportBinPath(dirs)
+	log.Printf("Added to the PATH of the subsequent Steps: %s", strings.Join(dirs, string(os.PathListSeparator)))
+}
 
-	if err := installCmd.Run(); err != nil {
-		if errorutil.IsExitStatusError(err) {
-			return fmt.Errorf("installing yarn failed: %s", err)
-		}
-		return fmt.Errorf("failed to run command: %s", err)
+// checkLockfileDrift exports whether running yarn changed the lockfiles, along with a patch of the changes.
+func checkLockfileDrift(lockfiles lockfileSnapshot, failOnDrift bool) error {
+	patch, err := lockfiles.diff()
+	if err != nil {
+		log.Warnf("Failed to check lockfile changes: %s", err)
+		return nil
+	}
+
+	changed := patch != ""
+	exportOutput("YARN_LOCKFILE_CHANGED", fmt.Sprintf("%t", changed))
+	if !changed {
+		return nil
+	}
+
+	fmt.Println()
+	log.Warnf("The yarn command changed the lockfiles")
+	if pth, err := exportLockfileDrift(patch); err != nil {
+		log.Warnf("Failed to export lockfile changes: %s", err)
+	} else {
+		log.Printf("Lockfile changes exported to: %s", pth)
 	}
 
+	if failOnDrift {
+		return fmt.Errorf("lockfiles changed, run yarn install locally and commit the updated lockfiles")
+	}
 	return nil
 }
 
-func printYarnVersion(workDir string) error {
-	log.Infof("Yarn version:")
-	versionCmd := command.New("yarn", "--version")
-	versionCmd.SetStdout(os.Stdout).SetStderr(os.Stderr).SetDir(workDir)
+func failf(format string, v ...interface{}) {
+	log.Errorf(format, v...)
+	os.Exit(1)
+}
 
-	fmt.Println()
-	log.Donef("$ %s", versionCmd.PrintableCommandArgs())
-	fmt.Println()
-	if err := versionCmd.Run(); err != nil {
-		if errorutil.IsExitStatusError(err) {
-			return fmt.Errorf("yarn version command failed: %s", err)
+func cacheYarn(workingDir string, yarnMajor uint64, pkg packageJSON, skipDirs, excludePatterns []string) error {
+	yarnCache := cache.New()
+
+	nodeLinker, err := findNodeLinker(yarnMajor, workingDir)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Node linker: %s", nodeLinker)
+
+	var cachePaths []string
+	// Plug'n'Play installs have no node_modules directories, the pnpm linker keeps the packages
+	// in the node_modules/.store directory of the root
+	if nodeLinker != nodeLinkerPnP {
+		// Supporting yarn workspaces (https://yarnpkg.com/lang/en/docs/workspaces/), for this look up the node_modules
+		// directories of the workspaces too
+		if cachePaths, err = findNodeModulesDirs(workingDir, pkg, skipDirs); err != nil {
+			return err
+		}
+	}
+	if yarnMajor >= 2 {
+		installPaths, err := berryInstallPaths(yarnMajor, workingDir, nodeLinker)
+		if err != nil {
+			return err
 		}
-		return fmt.Errorf("failed to run command: %s", err)
+		cachePaths = append(cachePaths, installPaths...)
 	}
 
+	log.Debugf("Cached paths: %s", cachePaths)
+	for _, path := range cachePaths {
+		// The dependencies only change with the lockfile, other changes (like timestamps) don't need a cache update
+		yarnCache.IncludePath(fmt.Sprintf("%s -> %s", path, nearestCacheIndicator(filepath.Dir(path), workingDir)))
+	}
+	for _, path := range cacheExcludePaths(workingDir, excludePatterns) {
+		yarnCache.ExcludePath(path)
+	}
+
+	if err := yarnCache.Commit(); err != nil {
+		return fmt.Errorf("failed to mark the installed dependencies to be cached: %s", err)
+	}
 	return nil
 }
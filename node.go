@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// nodeRequirement is a Node.js version constraint declared by the project.
+type nodeRequirement struct {
+	spec       string
+	source     string
+	constraint *semver.Constraints
+}
+
+func (r nodeRequirement) String() string {
+	return fmt.Sprintf("%s (%s)", r.spec, r.source)
+}
+
+// findNodeRequirements collects the Node.js version constraints from .nvmrc, .node-version, .tool-versions
+// and the engines.node field of package.json.
+func findNodeRequirements(dir string, pkg packageJSON) ([]nodeRequirement, error) {
+	var declared []nodeRequirement
+
+	for _, name := range []string{".nvmrc", ".node-version"} {
+		spec, err := readVersionFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if spec != "" {
+			declared = append(declared, nodeRequirement{spec: spec, source: name})
+		}
+	}
+
+	spec, err := readToolVersionsNode(filepath.Join(dir, ".tool-versions"))
+	if err != nil {
+		return nil, err
+	}
+	if spec != "" {
+		declared = append(declared, nodeRequirement{spec: spec, source: ".tool-versions"})
+	}
+
+	if pkg.Engines.Node != "" {
+		declared = append(declared, nodeRequirement{spec: pkg.Engines.Node, source: "engines.node in package.json"})
+	}
+
+	var requirements []nodeRequirement
+	for _, requirement := range declared {
+		constraint, err := semver.NewConstraint(strings.TrimPrefix(requirement.spec, "v"))
+		if err != nil {
+			// Aliases like lts/* or node can not be resolved without network access
+			log.Warnf("Ignoring Node.js version %s from %s: not a version or version range", requirement.spec, requirement.source)
+			continue
+		}
+		requirement.constraint = constraint
+		requirements = append(requirements, requirement)
+	}
+	return requirements, nil
+}
+
+// readVersionFile returns the first non-comment line of a version file, like .nvmrc.
+func readVersionFile(pth string) (string, error) {
+	var spec string
+	err := scanLines(pth, func(line string) bool {
+		spec = line
+		return false
+	})
+	return spec, err
+}
+
+// readToolVersionsNode returns the first Node.js version listed in an asdf .tool-versions file.
+func readToolVersionsNode(pth string) (string, error) {
+	var spec string
+	err := scanLines(pth, func(line string) bool {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && (fields[0] == "nodejs" || fields[0] == "node") {
+			spec = fields[1]
+			return false
+		}
+		return true
+	})
+	return spec, err
+}
+
+// scanLines calls fn with every non-empty, non-comment line of the file until fn returns false.
+// A missing file is not an error.
+func scanLines(pth string, fn func(line string) bool) error {
+	f, err := os.Open(pth)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %s", filepath.Base(pth), err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !fn(line) {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %s", filepath.Base(pth), err)
+	}
+	return nil
+}
+
+func getNodeVersion(nodePath string) (*semver.Version, error) {
+	out, err := command.New(nodePath, "--version").RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("node version command failed: %s, out: %s", err, out)
+	}
+
+	version, err := semver.NewVersion(out)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected node version output (%s): %s", out, err)
+	}
+	return version, nil
+}
+
+// detectNodeVersion returns the version of the Node.js used to run yarn, "unknown" if it can not be determined.
+func detectNodeVersion(nodePath string) string {
+	version, err := getNodeVersion(nodePath)
+	if err != nil {
+		log.Warnf("Failed to determine Node.js version: %s", err)
+		return "unknown"
+	}
+	return version.String()
+}
+
+func unsatisfiedNodeRequirements(version *semver.Version, requirements []nodeRequirement) []nodeRequirement {
+	var unsatisfied []nodeRequirement
+	for _, requirement := range requirements {
+		if !requirement.constraint.Check(version) {
+			unsatisfied = append(unsatisfied, requirement)
+		}
+	}
+	return unsatisfied
+}
+
+// ensureNodeVersion checks the Node.js on the PATH against the project's requirements.
+// If selectFromToolDir is set, a mismatching Node.js is replaced by the latest matching one from toolDir,
+// and the bin directory of the selected Node.js is returned.
+func ensureNodeVersion(requirements []nodeRequirement, selectFromToolDir bool, toolDir string) (string, error) {
+	version, err := getNodeVersion("node")
+	if err != nil {
+		if !selectFromToolDir {
+			return "", err
+		}
+		log.Warnf("%s", err)
+	} else {
+		unsatisfied := unsatisfiedNodeRequirements(version, requirements)
+		if len(unsatisfied) == 0 {
+			log.Infof("Node.js %s satisfies the project requirements", version)
+			return "", nil
+		}
+		if !selectFromToolDir {
+			return "", fmt.Errorf("the installed Node.js %s does not satisfy the required version: %s", version, joinNodeRequirements(unsatisfied))
+		}
+		log.Warnf("Node.js %s does not satisfy the required version: %s", version, joinNodeRequirements(unsatisfied))
+	}
+
+	binDir, selected, err := selectNodeVersion(toolDir, requirements)
+	if err != nil {
+		return "", err
+	}
+
+	log.Infof("Using Node.js %s from %s", selected, binDir)
+	return binDir, nil
+}
+
+// selectNodeVersion returns the bin directory of the latest Node.js in toolDir satisfying every requirement.
+// toolDir is expected to contain one directory per version (like `v18.17.0` or `18.17.0`), as nvm, nodenv and asdf do.
+func selectNodeVersion(toolDir string, requirements []nodeRequirement) (string, *semver.Version, error) {
+	entries, err := os.ReadDir(toolDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to list Node.js versions in %s: %s", toolDir, err)
+	}
+
+	var selectedDir string
+	var selected *semver.Version
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		version, err := semver.NewVersion(entry.Name())
+		if err != nil {
+			log.Debugf("Skipping %s: not a Node.js version directory", entry.Name())
+			continue
+		}
+		binDir := filepath.Join(toolDir, entry.Name(), "bin")
+		if _, err := os.Stat(filepath.Join(binDir, "node")); err != nil {
+			log.Debugf("Skipping %s: no node binary found", entry.Name())
+			continue
+		}
+
+		if len(unsatisfiedNodeRequirements(version, requirements)) == 0 && (selected == nil || version.GreaterThan(selected)) {
+			selectedDir, selected = binDir, version
+		}
+	}
+
+	if selected == nil {
+		return "", nil, fmt.Errorf("no Node.js version in %s satisfies the required version: %s", toolDir, joinNodeRequirements(requirements))
+	}
+	return selectedDir, selected, nil
+}
+
+func joinNodeRequirements(requirements []nodeRequirement) string {
+	var parts []string
+	for _, requirement := range requirements {
+		parts = append(parts, requirement.String())
+	}
+	return strings.Join(parts, ", ")
+}
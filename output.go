@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	outputTailLines   = 50
+	maxOutputLineSize = 64 * 1024
+)
+
+// outputInspector inspects the output of a yarn command line by line as it is written: it records which of the
+// known failure patterns occurred and keeps the last lines for error reporting. Its memory use does not depend on
+// the length of the output.
+type outputInspector struct {
+	mu       sync.Mutex
+	patterns []*regexp.Regexp
+	matched  map[*regexp.Regexp]bool
+	tail     []string
+	tailNext int
+	writers  []*lineWriter
+}
+
+func newOutputInspector(patterns []*regexp.Regexp, tailSize int) *outputInspector {
+	return &outputInspector{
+		patterns: patterns,
+		matched:  map[*regexp.Regexp]bool{},
+		tail:     make([]string, 0, tailSize),
+	}
+}
+
+// writer returns a writer splitting its input into lines for the inspector. Every output stream needs its own writer,
+// so that their partial lines don't get mixed.
+func (i *outputInspector) writer() io.Writer {
+	w := &lineWriter{inspector: i}
+	i.mu.Lock()
+	i.writers = append(i.writers, w)
+	i.mu.Unlock()
+	return w
+}
+
+// close inspects the unterminated last lines of the writers.
+func (i *outputInspector) close() {
+	i.mu.Lock()
+	writers := i.writers
+	i.mu.Unlock()
+
+	for _, w := range writers {
+		w.flush()
+	}
+}
+
+func (i *outputInspector) inspectLine(line string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, pattern := range i.patterns {
+		if !i.matched[pattern] && pattern.MatchString(line) {
+			i.matched[pattern] = true
+		}
+	}
+
+	if cap(i.tail) == 0 {
+		return
+	}
+	if len(i.tail) < cap(i.tail) {
+		i.tail = append(i.tail, line)
+		return
+	}
+	i.tail[i.tailNext] = line
+	i.tailNext = (i.tailNext + 1) % len(i.tail)
+}
+
+// matches returns whether any line of the output matched the pattern. Only the patterns the inspector was created with
+// are tracked.
+func (i *outputInspector) matches(pattern *regexp.Regexp) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.matched[pattern]
+}
+
+// lastLines returns the last n (at most the tail size) lines of the output.
+func (i *outputInspector) lastLines(n int) []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	lines := append(append([]string{}, i.tail[i.tailNext:]...), i.tail[:i.tailNext]...)
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// lineWriter splits its input into lines, lines longer than maxOutputLineSize are split into multiple lines.
+type lineWriter struct {
+	mu        sync.Mutex
+	inspector *outputInspector
+	partial   []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n := len(p)
+	for len(p) > 0 {
+		end := bytes.IndexByte(p, '\n')
+		if end < 0 {
+			end = len(p)
+		}
+
+		chunk := p[:end]
+		if room := maxOutputLineSize - len(w.partial); len(chunk) > room {
+			chunk = chunk[:room]
+		}
+		w.partial = append(w.partial, chunk...)
+		p = p[len(chunk):]
+
+		switch {
+		case len(p) > 0 && p[0] == '\n':
+			p = p[1:]
+			w.emit()
+		case len(w.partial) >= maxOutputLineSize:
+			w.emit()
+		}
+	}
+	return n, nil
+}
+
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.emit()
+	}
+}
+
+func (w *lineWriter) emit() {
+	w.inspector.inspectLine(strings.TrimSuffix(string(w.partial), "\r"))
+	w.partial = w.partial[:0]
+}
+
+// outputPatterns returns every pattern the failure handling looks for in the yarn output.
+func outputPatterns() []*regexp.Regexp {
+	patterns := transientFailurePatterns()
+	for _, category := range failureCategories {
+		patterns = append(patterns, category.patterns...)
+	}
+	return patterns
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/bitrise-io/go-steputils/tools"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	yarnFlavorClassic = "classic"
+	yarnFlavorBerry   = "berry"
+)
+
+// exportOutput exports a Step output with envman, a failed export is only reported.
+func exportOutput(key, value string) {
+	if err := tools.ExportEnvironmentWithEnvman(key, value); err != nil {
+		log.Warnf("Failed to export %s: %s", key, err)
+	}
+}
+
+func yarnFlavor(version *semver.Version) string {
+	if version.Major() >= 2 {
+		return yarnFlavorBerry
+	}
+	return yarnFlavorClassic
+}
+
+// exportRunOutputs exports the exit code of the first failed yarn command (0 if all of them succeeded)
+// and the time it took to run the commands.
+func exportRunOutputs(runErr error, duration time.Duration) {
+	code := 0
+	if runErr != nil {
+		code = exitCode(runErr)
+	}
+	exportOutput("YARN_EXIT_CODE", fmt.Sprintf("%d", code))
+	exportOutput("YARN_DURATION_SECONDS", fmt.Sprintf("%d", int(duration.Round(time.Second).Seconds())))
+}
+
+// workspaceOutput is an item of the YARN_WORKSPACES output.
+type workspaceOutput struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// exportWorkspaces exports the name and absolute path of the workspaces as a JSON list.
+func exportWorkspaces(rootDir string, workspaces []workspace) {
+	list := []workspaceOutput{}
+	for _, ws := range workspaces {
+		list = append(list, workspaceOutput{Name: ws.name, Path: filepath.Join(rootDir, filepath.FromSlash(ws.location))})
+	}
+
+	content, err := json.Marshal(list)
+	if err != nil {
+		log.Warnf("Failed to export YARN_WORKSPACES: %s", err)
+		return
+	}
+	exportOutput("YARN_WORKSPACES", string(content))
+}
+
+// nodeModulesBinPath returns the absolute path of the node_modules/.bin directory of the working directory,
+// an empty string if there is none (like with Plug'n'Play installs).
+func nodeModulesBinPath(workDir string) string {
+	pth := filepath.Join(workDir, "node_modules", ".bin")
+	if info, err := os.Stat(pth); err != nil || !info.IsDir() {
+		return ""
+	}
+	return pth
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type packageJSON struct {
+	Name           string            `json:"name"`
+	PackageManager string            `json:"packageManager"`
+	Scripts        map[string]string `json:"scripts"`
+	Workspaces     workspaceGlobs    `json:"workspaces"`
+
+	Dependencies         map[string]string `json:"dependencies"`
+	DevDependencies      map[string]string `json:"devDependencies"`
+	OptionalDependencies map[string]string `json:"optionalDependencies"`
+
+	Engines struct {
+		Node string `json:"node"`
+	} `json:"engines"`
+}
+
+// workspaceGlobs is the workspaces field of package.json, either a list of globs
+// or an object with a packages list (Yarn classic nohoist syntax).
+type workspaceGlobs []string
+
+func (w *workspaceGlobs) UnmarshalJSON(data []byte) error {
+	var globs []string
+	if err := json.Unmarshal(data, &globs); err == nil {
+		*w = globs
+		return nil
+	}
+
+	var withOptions struct {
+		Packages []string `json:"packages"`
+	}
+	if err := json.Unmarshal(data, &withOptions); err != nil {
+		return fmt.Errorf("workspaces should be a list of globs or an object with a packages list: %s", err)
+	}
+	*w = withOptions.Packages
+	return nil
+}
+
+// dependencyNames returns the names of all dependencies, regardless of their type.
+func (p packageJSON) dependencyNames() []string {
+	var names []string
+	for _, dependencies := range []map[string]string{p.Dependencies, p.DevDependencies, p.OptionalDependencies} {
+		for name := range dependencies {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// readPackageJSON parses the package.json file of the given directory.
+// A missing package.json is not an error, an empty model is returned instead.
+func readPackageJSON(dir string) (packageJSON, error) {
+	var pkg packageJSON
+
+	content, err := os.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pkg, nil
+		}
+		return pkg, fmt.Errorf("failed to read package.json: %s", err)
+	}
+
+	if err := json.Unmarshal(content, &pkg); err != nil {
+		return pkg, fmt.Errorf("failed to parse package.json: %s", err)
+	}
+	return pkg, nil
+}
+
+// declaredYarnVersion returns the Yarn version pinned by the packageManager field (for example `yarn@4.1.0+sha512.abc`).
+// An empty string is returned if the field is missing or refers to a different package manager.
+func (p packageJSON) declaredYarnVersion() (string, error) {
+	if p.PackageManager == "" {
+		return "", nil
+	}
+
+	parts := strings.SplitN(p.PackageManager, "@", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", fmt.Errorf("invalid packageManager field: %s", p.PackageManager)
+	}
+	if parts[0] != "yarn" {
+		return "", nil
+	}
+
+	// Strip the optional integrity hash
+	version := strings.SplitN(parts[1], "+", 2)[0]
+	return version, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultClassicNetworkTimeout = 30000
+	defaultBerryNetworkTimeout   = 60000
+	maxRetryDelay                = 2 * time.Minute
+)
+
+// transientFailure is an output pattern of a network failure, which might not happen again on a retry.
+type transientFailure struct {
+	pattern *regexp.Regexp
+	reason  string
+}
+
+var transientFailures = []transientFailure{
+	// Yarn classic
+	{regexp.MustCompile(`There appears to be trouble with your network connection`), "network connection trouble"},
+	// Yarn Berry fetch errors are reported as YN0001 (exceptions)
+	{regexp.MustCompile(`YN0001\b.*\b(RequestError|HTTPError|ReadError|TimeoutError)\b`), "package fetch error (YN0001)"},
+	{regexp.MustCompile(`ECONNRESET\b`), "connection reset (ECONNRESET)"},
+	{regexp.MustCompile(`E(SOCKET)?TIMEDOUT\b`), "connection timed out (ETIMEDOUT)"},
+	{regexp.MustCompile(`EAI_AGAIN\b`), "DNS lookup failed (EAI_AGAIN)"},
+	{regexp.MustCompile(`Request failed \\?"5\d\d`), "registry server error (HTTP 5xx)"},
+	{regexp.MustCompile(`Response code 5\d\d`), "registry server error (HTTP 5xx)"},
+	{regexp.MustCompile(`code E5\d\d\b`), "registry server error (HTTP 5xx)"},
+}
+
+// transientFailureReason returns why the output of a failed yarn command looks like a transient network failure,
+// an empty string if it does not.
+func transientFailureReason(output *outputInspector) string {
+	for _, failure := range transientFailures {
+		if output.matches(failure.pattern) {
+			return failure.reason
+		}
+	}
+	return ""
+}
+
+// retryPolicy controls how yarn commands failing with transient network errors are retried.
+type retryPolicy struct {
+	maxAttempts         int
+	initialDelay        time.Duration
+	jitter              bool
+	raiseNetworkTimeout bool
+	random              *rand.Rand
+}
+
+func newRetryPolicy(maxAttempts int, initialDelay time.Duration, jitter, raiseNetworkTimeout bool) retryPolicy {
+	return retryPolicy{
+		maxAttempts:         maxAttempts,
+		initialDelay:        initialDelay,
+		jitter:              jitter,
+		raiseNetworkTimeout: raiseNetworkTimeout,
+		random:              rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// delay returns the time to wait after the given (1-based) failed attempt: the initial delay doubled
+// after every attempt, plus up to 50% random jitter.
+func (p retryPolicy) delay(attempt int) time.Duration {
+	delay := p.initialDelay
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+
+	if p.jitter && p.random != nil && delay > 0 {
+		delay += time.Duration(p.random.Int63n(int64(delay)/2 + 1))
+	}
+	return delay
+}
+
+// withRaisedNetworkTimeout doubles the network timeout of the invocation: the --network-timeout flag on Yarn classic,
+// the YARN_HTTP_TIMEOUT environment variable (httpTimeout setting) on Yarn Berry.
+func withRaisedNetworkTimeout(invocation yarnInvocation, yarnMajor uint64) (yarnInvocation, int) {
+	if yarnMajor >= 2 {
+		timeout := defaultBerryNetworkTimeout
+		if value, ok := lookupEnv(invocation.envs, "YARN_HTTP_TIMEOUT"); ok {
+			timeout = parseTimeout(value, timeout)
+		} else if value := os.Getenv("YARN_HTTP_TIMEOUT"); value != "" {
+			timeout = parseTimeout(value, timeout)
+		}
+
+		timeout *= 2
+		invocation.envs = append(append([]string{}, invocation.envs...), "YARN_HTTP_TIMEOUT="+strconv.Itoa(timeout))
+		return invocation, timeout
+	}
+
+	timeout := defaultClassicNetworkTimeout
+	var args []string
+	end := yarnOwnArgsEnd(yarnMajor, invocation.args)
+	i := 0
+	for ; i < end; i++ {
+		arg := invocation.args[i]
+		switch {
+		case arg == "--network-timeout" && i+1 < len(invocation.args):
+			timeout = parseTimeout(invocation.args[i+1], timeout)
+			i++
+		case strings.HasPrefix(arg, "--network-timeout="):
+			timeout = parseTimeout(strings.TrimPrefix(arg, "--network-timeout="), timeout)
+		default:
+			args = append(args, arg)
+		}
+	}
+
+	args = append(args, invocation.args[i:]...)
+
+	timeout *= 2
+	// Added before the command, so that it is not passed on to scripts
+	invocation.args = append([]string{"--network-timeout", strconv.Itoa(timeout)}, args...)
+	return invocation, timeout
+}
+
+// lookupEnv returns the last value of the key in a list of KEY=value environment variables.
+func lookupEnv(envs []string, key string) (string, bool) {
+	value, found := "", false
+	for _, env := range envs {
+		if strings.HasPrefix(env, key+"=") {
+			value, found = strings.TrimPrefix(env, key+"="), true
+		}
+	}
+	return value, found
+}
+
+func parseTimeout(value string, defaultTimeout int) int {
+	timeout, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || timeout <= 0 {
+		return defaultTimeout
+	}
+	return timeout
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/bitrise-io/go-utils/errorutil"
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/kballard/go-shellquote"
+)
+
+// yarnInvocation is a validated and translated yarn command, ready to run.
+type yarnInvocation struct {
+	commandLine string
+	command     string
+	args        []string
+	envs        []string
+	isInstall   bool
+}
+
+// yarnRunner runs yarn commands with the Yarn set up for the working directory.
+type yarnRunner struct {
+	yarn         yarnExecutable
+	yarnVersion  *semver.Version
+	workDir      string
+	rootDir      string
+	pkg          packageJSON
+	lockfileMode string
+	retry        retryPolicy
+	timeouts     commandTimeouts
+	commandLog   *commandLog
+	redactor     redactor
+}
+
+// commandResult is the outcome of an invocation.
+type commandResult struct {
+	invocation yarnInvocation
+	duration   time.Duration
+	err        error
+	skipped    bool
+}
+
+// parseCommands splits the commands input into one yarn command line per non-empty line.
+func parseCommands(commands string) ([][]string, error) {
+	var commandLines [][]string
+	for _, line := range strings.Split(commands, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		params, err := shellquote.Split(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid CLI command: %s", line, err)
+		}
+		commandLines = append(commandLines, params)
+	}
+	return commandLines, nil
+}
+
+// prepareAll prepares the commands of the commands input, or the single command built from the command and args inputs
+// if commandLines is nil.
+func (r yarnRunner) prepareAll(commandParams, args []string, commandLines [][]string) ([]yarnInvocation, error) {
+	if commandLines == nil {
+		invocation, err := r.prepare(commandParams, args)
+		if err != nil {
+			return nil, err
+		}
+		return []yarnInvocation{invocation}, nil
+	}
+
+	var invocations []yarnInvocation
+	for _, commandLine := range commandLines {
+		invocation, err := r.prepare(commandLine, nil)
+		if err != nil {
+			return nil, err
+		}
+		invocations = append(invocations, invocation)
+	}
+	return invocations, nil
+}
+
+// prepare translates the yarn command for the Yarn in use.
+func (r yarnRunner) prepare(commandParams, args []string) (yarnInvocation, error) {
+	commandLine := append(append([]string{}, commandParams...), args...)
+	yarnArgs, envs, err := translateYarnArgs(r.yarnVersion.Major(), commandLine, r.redactor)
+	if err != nil {
+		return yarnInvocation{}, err
+	}
+
+	isInstall := isInstallCommand(commandLine)
+	if isInstall {
+		lockfileFlags, lockfileEnvs := lockfileEnforcement(r.lockfileMode, r.yarnVersion.Major(), r.workDir)
+		for _, flag := range lockfileFlags {
+			if !containsString(yarnArgs, flag) {
+				yarnArgs = append(yarnArgs, flag)
+			}
+		}
+		envs = append(envs, lockfileEnvs...)
+	}
+
+	return yarnInvocation{
+		commandLine: r.redactor.redact(strings.Join(append([]string{"yarn"}, commandLine...), " ")),
+		command:     yarnSubcommand(commandLine),
+		args:        yarnArgs,
+		envs:        envs,
+		isInstall:   isInstall,
+	}, nil
+}
+
+// yarnSubcommand returns the yarn command of a command line, an empty string for a bare `yarn` (install).
+func yarnSubcommand(yarnArgs []string) string {
+	if i := subcommandIndex(yarnArgs); i >= 0 {
+		return yarnArgs[i]
+	}
+	return ""
+}
+
+// isInstallCommand returns whether the command line installs the dependencies:
+// `yarn install` or a bare `yarn`, unless it only prints the version or the help.
+func isInstallCommand(yarnArgs []string) bool {
+	if command := yarnSubcommand(yarnArgs); command != "" && command != "install" {
+		return false
+	}
+	for _, arg := range yarnArgs {
+		switch arg {
+		case "--version", "-v", "--help", "-h":
+			return false
+		}
+	}
+	return true
+}
+
+// runsInstall returns whether any of the commands installs the dependencies.
+func runsInstall(commandParams, args []string, commandLines [][]string) bool {
+	if commandLines == nil {
+		commandLines = [][]string{append(append([]string{}, commandParams...), args...)}
+	}
+	for _, commandLine := range commandLines {
+		if isInstallCommand(commandLine) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the yarn command of the invocation. It is called right before the invocation runs,
+// as dependency binaries are only available once the dependencies are installed (or restored from the cache).
+func (r yarnRunner) validate(invocation yarnInvocation) error {
+	err := validateYarnCommand(r.yarnVersion.Major(), r.workDir, r.rootDir, r.pkg, invocation.command)
+	var unknownErr *unknownCommandError
+	if errors.As(err, &unknownErr) {
+		return &commandFailure{reason: "missing_script", err: err}
+	}
+	return err
+}
+
+func (r yarnRunner) run(invocation yarnInvocation) error {
+	for attempt := 1; ; attempt++ {
+		output, err := r.runAttempt(invocation, attempt)
+		if err == nil {
+			return nil
+		}
+
+		var timeoutErr *timeoutError
+		if errors.As(err, &timeoutErr) {
+			fmt.Println()
+			log.Errorf("Last lines of the output:")
+			for _, line := range output.lastLines(timeoutOutputLines) {
+				log.Printf("%s", line)
+			}
+			return &commandFailure{reason: failureReasonTimeout, err: fmt.Errorf("provided yarn command timed out: %w", err)}
+		}
+		if !errorutil.IsExitStatusError(err) {
+			return fmt.Errorf("failed to run provided yarn command: %s", err)
+		}
+
+		reason := transientFailureReason(output)
+		if reason != "" && attempt < r.retry.maxAttempts {
+			delay := r.retry.delay(attempt)
+			fmt.Println()
+			log.Warnf("Attempt %d/%d failed: %s, retrying in %s", attempt, r.retry.maxAttempts, reason, delay.Round(time.Second))
+			if r.retry.raiseNetworkTimeout {
+				var timeout int
+				invocation, timeout = withRaisedNetworkTimeout(invocation, r.yarnVersion.Major())
+				log.Printf("Network timeout raised to %d ms", timeout)
+			}
+			time.Sleep(delay)
+			continue
+		}
+		if reason != "" && r.retry.maxAttempts > 1 {
+			fmt.Println()
+			log.Warnf("The command failed with a network error (%s) in all %d attempts.", reason, attempt)
+		}
+
+		category := classifyFailure(output)
+		if category == nil {
+			return &commandFailure{reason: failureReasonUnknown, err: fmt.Errorf("provided yarn command failed: %w", err)}
+		}
+
+		printFailureDiagnostics(category)
+		if category.reason == "lockfile" && invocation.isInstall {
+			printStaleLockfileEntries(r.workDir, r.pkg)
+		}
+		return &commandFailure{reason: category.reason, err: fmt.Errorf("provided yarn command failed (%s): %w", category.reason, err)}
+	}
+}
+
+// runAttempt runs the invocation once and returns the inspector of its output.
+func (r yarnRunner) runAttempt(invocation yarnInvocation, attempt int) (*outputInspector, error) {
+	yarn := r.yarn
+	yarn.envs = append(append([]string{}, r.yarn.envs...), invocation.envs...)
+
+	yarnCmd := yarn.command(invocation.args...)
+	printableCommand := r.redactor.redact(yarnCmd.PrintableCommandArgs())
+	output := newOutputInspector(outputPatterns(), outputTailLines)
+	stdout, stderr := io.MultiWriter(os.Stdout, output.writer()), io.MultiWriter(os.Stderr, output.writer())
+	if r.commandLog != nil {
+		stdout, stderr = io.MultiWriter(stdout, r.commandLog), io.MultiWriter(stderr, r.commandLog)
+		r.commandLog.startInvocation(invocation.commandLine, printableCommand, r.workDir, attempt, r.redactor.redactAll(yarn.envs))
+	}
+	// Secrets are masked before the output reaches any of its destinations
+	redactedStdout, redactedStderr := r.redactor.writer(stdout), r.redactor.writer(stderr)
+	yarnCmd.SetDir(r.workDir)
+	yarnCmd.SetStdout(redactedStdout).SetStderr(redactedStderr)
+
+	fmt.Println()
+	log.Donef("$ %s", printableCommand)
+	fmt.Println()
+
+	start := time.Now()
+	err := runWithTimeouts(yarnCmd.GetCmd(), r.timeouts)
+	redactedStdout.flush()
+	redactedStderr.flush()
+	output.close()
+	if r.commandLog != nil {
+		r.commandLog.finishInvocation(time.Since(start), err)
+	}
+	return output, err
+}
+
+// runPipeline runs the invocations one after the other. If continueOnError is not set,
+// the invocations following a failed one are skipped.
+func (r yarnRunner) runPipeline(invocations []yarnInvocation, continueOnError bool) []commandResult {
+	isPipeline := len(invocations) > 1
+
+	var results []commandResult
+	failed := false
+	for i, invocation := range invocations {
+		if failed && !continueOnError {
+			results = append(results, commandResult{invocation: invocation, skipped: true})
+			continue
+		}
+
+		if isPipeline {
+			fmt.Println()
+			log.Infof("(%d/%d) %s", i+1, len(invocations), invocation.commandLine)
+		}
+
+		start := time.Now()
+		err := r.validate(invocation)
+		if err == nil {
+			err = r.run(invocation)
+		}
+		results = append(results, commandResult{invocation: invocation, duration: time.Since(start), err: err})
+
+		if err != nil {
+			failed = true
+			if isPipeline {
+				log.Errorf("%s failed: %s", invocation.commandLine, err)
+			}
+		}
+	}
+
+	if isPipeline {
+		printPipelineSummary(results)
+	}
+	return results
+}
+
+func printPipelineSummary(results []commandResult) {
+	fmt.Println()
+	log.Infof("Summary:")
+	for _, result := range results {
+		line := fmt.Sprintf("%-40s", result.invocation.commandLine)
+		switch {
+		case result.skipped:
+			log.Printf("- %s skipped", line)
+		case result.err != nil:
+			log.Errorf("✗ %s %6.1fs exit status %d", line, result.duration.Seconds(), exitCode(result.err))
+		default:
+			log.Donef("✓ %s %6.1fs exit status 0", line, result.duration.Seconds())
+		}
+	}
+}
+
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// firstFailure returns the error of the first failed invocation.
+func firstFailure(results []commandResult) error {
+	for _, result := range results {
+		if result.err != nil {
+			if len(results) > 1 {
+				return fmt.Errorf("%s: %w", result.invocation.commandLine, result.err)
+			}
+			return result.err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestIsInstallCommand(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{args: nil, want: true},
+		{args: []string{"install"}, want: true},
+		{args: []string{"--frozen-lockfile"}, want: true},
+		{args: []string{"--cwd", "app", "install"}, want: true},
+		{args: []string{"add", "lodash"}, want: false},
+		{args: []string{"run", "install"}, want: false},
+		{args: []string{"--version"}, want: false},
+		{args: []string{"-v"}, want: false},
+		{args: []string{"--help"}, want: false},
+		{args: []string{"install", "--help"}, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isInstallCommand(tt.args); got != tt.want {
+			t.Errorf("isInstallCommand(%q) = %t, want %t", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestRunsInstall(t *testing.T) {
+	tests := []struct {
+		name          string
+		commandParams []string
+		args          []string
+		commandLines  [][]string
+		want          bool
+	}{
+		{name: "bare yarn", want: true},
+		{name: "command in the args input", args: []string{"add", "lodash"}, want: false},
+		{name: "install flags in the args input", args: []string{"--frozen-lockfile"}, want: true},
+		{name: "command with args", commandParams: []string{"install"}, args: []string{"--production"}, want: true},
+		{name: "commands without install", commandLines: [][]string{{"--version"}, {"test"}}, want: false},
+		{name: "commands with install", commandLines: [][]string{{"--version"}, {"install"}, {"test"}}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := runsInstall(tt.commandParams, tt.args, tt.commandLines); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	timeoutCheckInterval = time.Second
+	terminationGrace     = 10 * time.Second
+	killGrace            = 5 * time.Second
+	timeoutOutputLines   = 20
+)
+
+// timeoutError is returned when a yarn command is terminated for running too long or not writing any output.
+type timeoutError struct {
+	reason string
+	limit  time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s (%s), the command was terminated", e.reason, e.limit)
+}
+
+// commandTimeouts limits how long a yarn command may run, 0 disables a limit.
+type commandTimeouts struct {
+	overall  time.Duration
+	noOutput time.Duration
+}
+
+func (t commandTimeouts) isSet() bool {
+	return t.overall > 0 || t.noOutput > 0
+}
+
+// activityWriter records the time of the last write.
+type activityWriter struct {
+	mu        sync.Mutex
+	lastWrite time.Time
+}
+
+func (w *activityWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastWrite = time.Now()
+	return len(p), nil
+}
+
+func (w *activityWriter) sinceLastWrite() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Since(w.lastWrite)
+}
+
+// outputPipes copies the output of a command through pipes owned by the step. Unlike the pipes created by exec,
+// they can be closed while processes which escaped the process group still hold their write ends.
+type outputPipes struct {
+	readers []*os.File
+	writers []*os.File
+	copying sync.WaitGroup
+}
+
+// pipeOutput replaces the stdout and stderr writers of the command with pipes copied to the original writers and w.
+func pipeOutput(cmd *exec.Cmd, w io.Writer) (*outputPipes, error) {
+	p := &outputPipes{}
+	for _, output := range []*io.Writer{&cmd.Stdout, &cmd.Stderr} {
+		r, pw, err := os.Pipe()
+		if err != nil {
+			p.closeWriters()
+			p.closeReaders()
+			return nil, fmt.Errorf("failed to create output pipe: %s", err)
+		}
+		p.readers = append(p.readers, r)
+		p.writers = append(p.writers, pw)
+
+		dst := w
+		if *output != nil {
+			dst = io.MultiWriter(*output, w)
+		}
+		p.copying.Add(1)
+		go func() {
+			defer p.copying.Done()
+			_, _ = io.Copy(dst, r)
+		}()
+		*output = pw
+	}
+	return p, nil
+}
+
+func (p *outputPipes) closeWriters() {
+	for _, w := range p.writers {
+		_ = w.Close()
+	}
+}
+
+func (p *outputPipes) closeReaders() {
+	for _, r := range p.readers {
+		_ = r.Close()
+	}
+}
+
+// wait waits until all writers of the pipes are closed and the output is copied.
+func (p *outputPipes) wait() {
+	p.copying.Wait()
+	p.closeReaders()
+}
+
+// abandon stops copying the output, even if some processes still hold the write ends of the pipes.
+func (p *outputPipes) abandon() {
+	p.closeReaders()
+	p.copying.Wait()
+}
+
+// runWithTimeouts runs the command in its own process group. If a timeout expires the whole process group
+// (yarn, node and the scripts started by them) is terminated, and a timeoutError is returned.
+func runWithTimeouts(cmd *exec.Cmd, timeouts commandTimeouts) error {
+	if !timeouts.isSet() {
+		return cmd.Run()
+	}
+
+	activity := &activityWriter{lastWrite: time.Now()}
+	output, err := pipeOutput(cmd, activity)
+	if err != nil {
+		return err
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	start := time.Now()
+	err = cmd.Start()
+	// The started processes hold their own copies of the write ends
+	output.closeWriters()
+	if err != nil {
+		output.closeReaders()
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		output.wait()
+		done <- err
+	}()
+
+	ticker := time.NewTicker(timeoutCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			var expired *timeoutError
+			switch {
+			case timeouts.overall > 0 && time.Since(start) > timeouts.overall:
+				expired = &timeoutError{reason: "the command did not finish in time", limit: timeouts.overall}
+			case timeouts.noOutput > 0 && activity.sinceLastWrite() > timeouts.noOutput:
+				expired = &timeoutError{reason: "the command did not write any output", limit: timeouts.noOutput}
+			}
+			if expired != nil {
+				terminateProcessGroup(cmd.Process.Pid, done, output)
+				return expired
+			}
+		}
+	}
+}
+
+// terminateProcessGroup sends SIGTERM to the process group, then SIGKILL if it is still running after a grace period.
+// If the output is still not closed shortly after SIGKILL, it is abandoned without waiting for the command to finish.
+func terminateProcessGroup(pid int, done <-chan error, output *outputPipes) {
+	fmt.Println()
+	log.Warnf("Terminating the yarn process group (SIGTERM)")
+	if err := syscall.Kill(-pid, syscall.SIGTERM); err != nil {
+		log.Warnf("Failed to terminate the yarn process group: %s", err)
+	}
+
+	select {
+	case <-done:
+		// Child processes ignoring SIGTERM might still be running
+		_ = syscall.Kill(-pid, syscall.SIGKILL)
+	case <-time.After(terminationGrace):
+		log.Warnf("The yarn process group is still running after %s, killing it (SIGKILL)", terminationGrace)
+		// ESRCH: the process group is gone, only its output is still open
+		if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			log.Warnf("Failed to kill the yarn process group: %s", err)
+		}
+
+		select {
+		case <-done:
+		case <-time.After(killGrace):
+			// Processes outside of the process group (e.g. daemons started by a script) can keep the output open
+			log.Warnf("The output of the yarn command is still open %s after killing it, stop waiting for it", killGrace)
+			output.abandon()
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/bitrise-io/go-steputils/cache"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// yarnToolCache stores extracted Yarn release tarballs by version: <dir>/<version>/<tarball root>/bin/yarn.js
+type yarnToolCache struct {
+	dir string
+}
+
+// lookup returns the latest cached Yarn release matching the requirement.
+func (c yarnToolCache) lookup(requirement *yarnRequirement) (yarnExecutable, *semver.Version, bool) {
+	if c.dir == "" {
+		return yarnExecutable{}, nil, false
+	}
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Failed to read Yarn tool cache: %s", err)
+		}
+		return yarnExecutable{}, nil, false
+	}
+
+	var latestEntrypoint string
+	var latest *semver.Version
+	for _, entry := range entries {
+		version, err := semver.StrictNewVersion(entry.Name())
+		if err != nil || !entry.IsDir() || !requirement.isSatisfiedBy(version) {
+			continue
+		}
+		if latest != nil && !version.GreaterThan(latest) {
+			continue
+		}
+
+		entrypoint, err := findYarnEntrypoint(filepath.Join(c.dir, entry.Name()))
+		if err != nil {
+			log.Debugf("Skipping cached Yarn %s: %s", version, err)
+			continue
+		}
+		latestEntrypoint, latest = entrypoint, version
+	}
+
+	if latest == nil {
+		return yarnExecutable{}, nil, false
+	}
+	return yarnExecutable{name: "node", args: []string{latestEntrypoint}}, latest, true
+}
+
+// fetch downloads a Yarn release from the npm registry and stores it in the tool cache.
+// An empty version fetches the latest Yarn classic release.
+func (c yarnToolCache) fetch(version, nodeBinDir string) (yarnExecutable, error) {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return yarnExecutable{}, fmt.Errorf("failed to create Yarn tool cache: %s", err)
+	}
+	tmpDir, err := os.MkdirTemp(c.dir, ".download")
+	if err != nil {
+		return yarnExecutable{}, fmt.Errorf("failed to create temporary directory: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			log.Warnf("Failed to remove temporary directory: %s", err)
+		}
+	}()
+
+	pkg := "yarn"
+	if !isYarnClassic(version) {
+		pkg = "@yarnpkg/cli-dist"
+	}
+	if version != "" {
+		pkg += "@" + version
+	}
+
+	packCmd := nodeToolCommand(nodeBinDir, "npm", "pack", pkg).SetDir(tmpDir)
+	log.Donef("$ %s", packCmd.PrintableCommandArgs())
+	out, err := packCmd.RunAndReturnTrimmedOutput()
+	if err != nil {
+		return yarnExecutable{}, fmt.Errorf("failed to download %s: %s, out: %s", pkg, err, out)
+	}
+	lines := strings.Split(out, "\n")
+	tarball := filepath.Join(tmpDir, strings.TrimSpace(lines[len(lines)-1]))
+
+	extractDir := filepath.Join(tmpDir, "release")
+	if err := os.Mkdir(extractDir, 0755); err != nil {
+		return yarnExecutable{}, fmt.Errorf("failed to create temporary directory: %s", err)
+	}
+	entrypoint, err := extractYarnTarball(tarball, extractDir)
+	if err != nil {
+		return yarnExecutable{}, err
+	}
+
+	released, err := readReleaseVersion(filepath.Dir(filepath.Dir(entrypoint)))
+	if err != nil {
+		return yarnExecutable{}, err
+	}
+
+	versionDir := filepath.Join(c.dir, released)
+	if err := os.RemoveAll(versionDir); err != nil {
+		return yarnExecutable{}, fmt.Errorf("failed to remove outdated Yarn %s from the tool cache: %s", released, err)
+	}
+	if err := os.Rename(extractDir, versionDir); err != nil {
+		return yarnExecutable{}, fmt.Errorf("failed to store Yarn %s in the tool cache: %s", released, err)
+	}
+
+	entrypoint, err = findYarnEntrypoint(versionDir)
+	if err != nil {
+		return yarnExecutable{}, err
+	}
+	log.Printf("Stored Yarn %s in the tool cache: %s", released, versionDir)
+	return yarnExecutable{name: "node", args: []string{entrypoint}}, nil
+}
+
+// commit marks the tool cache to be persisted by the Bitrise cache.
+func (c yarnToolCache) commit() error {
+	if c.dir == "" {
+		return nil
+	}
+	if _, err := os.Stat(c.dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	toolCache := cache.New()
+	toolCache.IncludePath(c.dir)
+	return toolCache.Commit()
+}
+
+func readReleaseVersion(packageDir string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(packageDir, "package.json"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read Yarn release manifest: %s", err)
+	}
+
+	var manifest struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return "", fmt.Errorf("failed to parse Yarn release manifest: %s", err)
+	}
+	if _, err := semver.StrictNewVersion(manifest.Version); err != nil {
+		return "", fmt.Errorf("invalid Yarn release version (%s): %s", manifest.Version, err)
+	}
+	return manifest.Version, nil
+}
+
+// toolCacheInstaller downloads the requested release into the tool cache, so later builds can reuse it.
+type toolCacheInstaller struct {
+	cache      yarnToolCache
+	nodeBinDir string
+}
+
+func (toolCacheInstaller) name() string {
+	return "tool cache"
+}
+
+func (i toolCacheInstaller) install(_, version string) (yarnExecutable, error) {
+	if i.cache.dir == "" {
+		return yarnExecutable{}, skipf("no tool cache directory provided")
+	}
+	if _, err := exec.LookPath(nodeToolPath(i.nodeBinDir, "npm")); err != nil {
+		return yarnExecutable{}, skipf("npm is not available")
+	}
+	return i.cache.fetch(version, i.nodeBinDir)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// flagRule rewrites a yarn flag to its equivalent in the other Yarn flavor.
+type flagRule struct {
+	flag        string
+	hasValue    bool
+	installOnly bool
+	// command replaces the yarn command (for example `install`) when the flag is present
+	command []string
+	rewrite func(value string) (flags []string, envs []string, err error)
+}
+
+func replaceWith(flags ...string) func(string) ([]string, []string, error) {
+	return func(string) ([]string, []string, error) {
+		return flags, nil, nil
+	}
+}
+
+func setEnv(key string) func(string) ([]string, []string, error) {
+	return func(value string) ([]string, []string, error) {
+		return nil, []string{key + "=" + value}, nil
+	}
+}
+
+func noEquivalent(hint string) func(string) ([]string, []string, error) {
+	return func(string) ([]string, []string, error) {
+		return nil, nil, fmt.Errorf("%s", hint)
+	}
+}
+
+// classicToBerryRules rewrite Yarn classic (1.x) flags for Yarn Berry (2+).
+var classicToBerryRules = []flagRule{
+	{flag: "--frozen-lockfile", installOnly: true, rewrite: replaceWith("--immutable")},
+	{flag: "--pure-lockfile", installOnly: true, rewrite: noEquivalent("Yarn Berry always updates the lockfile when needed, use --immutable to fail instead")},
+	{flag: "--no-lockfile", installOnly: true, rewrite: noEquivalent("Yarn Berry always uses a lockfile")},
+	{flag: "--check-files", installOnly: true, rewrite: noEquivalent("use --check-cache to verify the checksums of the cached packages instead")},
+	{flag: "--ignore-scripts", installOnly: true, rewrite: replaceWith("--mode=skip-build")},
+	{flag: "--ignore-engines", installOnly: true, rewrite: replaceWith()},
+	{flag: "--production", installOnly: true, command: []string{"workspaces", "focus", "--all"}, rewrite: replaceWith("--production")},
+	{flag: "--network-timeout", hasValue: true, rewrite: setEnv("YARN_HTTP_TIMEOUT")},
+	{flag: "--registry", hasValue: true, rewrite: setEnv("YARN_NPM_REGISTRY_SERVER")},
+	{flag: "--no-progress", rewrite: func(string) ([]string, []string, error) {
+		return nil, []string{"YARN_ENABLE_PROGRESS_BARS=false"}, nil
+	}},
+	{flag: "--non-interactive", rewrite: replaceWith()},
+	{flag: "--silent", rewrite: replaceWith()},
+}
+
+// berryToClassicRules rewrite Yarn Berry (2+) flags for Yarn classic (1.x).
+var berryToClassicRules = []flagRule{
+	{flag: "--immutable", installOnly: true, rewrite: replaceWith("--frozen-lockfile")},
+	{flag: "--immutable-cache", installOnly: true, rewrite: noEquivalent("Yarn classic can not protect its cache from changes")},
+	{flag: "--check-cache", installOnly: true, rewrite: noEquivalent("use --check-files to verify the installed files instead")},
+	{flag: "--inline-builds", installOnly: true, rewrite: replaceWith()},
+	{flag: "--mode", hasValue: true, installOnly: true, rewrite: func(value string) ([]string, []string, error) {
+		if value == "skip-build" {
+			return []string{"--ignore-scripts"}, nil, nil
+		}
+		return nil, nil, fmt.Errorf("only --mode=skip-build has an equivalent")
+	}},
+}
+
+// translateYarnArgs rewrites the flags of the yarn command known to differ between Yarn classic and Berry
+// to the flavor of the Yarn in use. It returns the rewritten arguments and the environment variables
+// replacing flags that are configuration settings in the target flavor. Flag values are redacted in the log.
+func translateYarnArgs(yarnMajor uint64, yarnArgs []string, redactor redactor) ([]string, []string, error) {
+	rules, flavor := berryToClassicRules, "Yarn classic"
+	if yarnMajor >= 2 {
+		rules, flavor = classicToBerryRules, "Yarn Berry"
+	}
+
+	isInstall := isInstallCommand(yarnArgs)
+
+	// The arguments of scripts and binaries are passed on as is
+	end := yarnOwnArgsEnd(yarnMajor, yarnArgs)
+
+	var translated, envs, replacedCommand []string
+	i := 0
+	for ; i < end; i++ {
+		arg := yarnArgs[i]
+		name, value, hasInlineValue := splitFlag(arg)
+
+		rule, ok := findFlagRule(rules, name)
+		if !ok || (rule.installOnly && !isInstall) {
+			translated = append(translated, arg)
+			continue
+		}
+
+		original := arg
+		if rule.hasValue && !hasInlineValue {
+			if i+1 >= len(yarnArgs) {
+				return nil, nil, fmt.Errorf("flag %s requires a value", name)
+			}
+			i++
+			value = yarnArgs[i]
+			original += " " + value
+		}
+
+		flags, flagEnvs, err := rule.rewrite(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("flag %s is not supported by %s: %s", redactor.redact(original), flavor, err)
+		}
+		translated = append(translated, flags...)
+		envs = append(envs, flagEnvs...)
+		if rule.command != nil {
+			replacedCommand = rule.command
+		}
+
+		log.Printf("Rewrote %s for %s: %s", redactor.redact(original), flavor, redactor.redact(describeRewrite(rule.command, flags, flagEnvs)))
+	}
+
+	translated = append(translated, yarnArgs[i:]...)
+
+	if replacedCommand != nil {
+		// The commands replacing install (like `workspaces focus`) have no --immutable flag, but respect the setting
+		if i := indexOfString(translated, "--immutable"); i >= 0 {
+			translated = append(translated[:i:i], translated[i+1:]...)
+			envs = append(envs, "YARN_ENABLE_IMMUTABLE_INSTALLS=true")
+			log.Printf("Rewrote --immutable for yarn %s: YARN_ENABLE_IMMUTABLE_INSTALLS=true", strings.Join(replacedCommand, " "))
+		}
+		translated = replaceSubcommand(translated, replacedCommand)
+	}
+
+	return translated, envs, nil
+}
+
+// yarnValueFlags are the yarn flags taking their value as the next argument.
+var yarnValueFlags = []string{
+	"--cache-folder", "--cwd", "--global-folder", "--https-proxy", "--link-folder", "--mode", "--modules-folder",
+	"--mutex", "--network-concurrency", "--network-timeout", "--otp", "--preferred-cache-folder", "--proxy",
+	"--registry", "--use-yarnrc",
+}
+
+// subcommandIndex returns the index of the first argument that is neither a flag nor the value of a flag,
+// -1 if there is none.
+func subcommandIndex(yarnArgs []string) int {
+	for i := 0; i < len(yarnArgs); i++ {
+		arg := yarnArgs[i]
+		if !strings.HasPrefix(arg, "-") {
+			return i
+		}
+		if name, _, hasInlineValue := splitFlag(arg); !hasInlineValue && containsString(yarnValueFlags, name) {
+			i++
+		}
+	}
+	return -1
+}
+
+// yarnOwnArgsEnd returns the index of the first argument passed on to a script or binary instead of being
+// an argument of yarn itself, len(yarnArgs) if there is none. Yarn passes on the arguments after the script
+// or binary name (`yarn jest --ci`, `yarn run build --prod`) and after exec and dlx.
+func yarnOwnArgsEnd(yarnMajor uint64, yarnArgs []string) int {
+	i := subcommandIndex(yarnArgs)
+	if i < 0 {
+		return len(yarnArgs)
+	}
+
+	builtins := classicCommands
+	if yarnMajor >= 2 {
+		builtins = berryCommands
+	}
+
+	switch subcommand := yarnArgs[i]; {
+	case subcommand == "exec" || subcommand == "dlx" || subcommand == "node" || subcommand == "test":
+		return i + 1
+	case subcommand == "run":
+		if script := subcommandIndex(yarnArgs[i+1:]); script >= 0 {
+			return i + 1 + script + 1
+		}
+		return len(yarnArgs)
+	case subcommand == "workspace":
+		// yarn workspace <name> <command>
+		if name := subcommandIndex(yarnArgs[i+1:]); name >= 0 {
+			start := i + 1 + name + 1
+			return start + yarnOwnArgsEnd(yarnMajor, yarnArgs[start:])
+		}
+		return len(yarnArgs)
+	case containsString(builtins, subcommand):
+		return len(yarnArgs)
+	}
+	return i + 1
+}
+
+func indexOfString(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+func splitFlag(arg string) (string, string, bool) {
+	if !strings.HasPrefix(arg, "--") {
+		return arg, "", false
+	}
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) == 1 {
+		return arg, "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func findFlagRule(rules []flagRule, flag string) (flagRule, bool) {
+	for _, rule := range rules {
+		if rule.flag == flag {
+			return rule, true
+		}
+	}
+	return flagRule{}, false
+}
+
+// replaceSubcommand replaces the leading `install` command (or the implicit install of a bare `yarn`) with command.
+func replaceSubcommand(yarnArgs, command []string) []string {
+	for i, arg := range yarnArgs {
+		if arg == "install" {
+			yarnArgs = append(yarnArgs[:i:i], yarnArgs[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			break
+		}
+	}
+	return append(append([]string{}, command...), yarnArgs...)
+}
+
+func describeRewrite(command, flags, envs []string) string {
+	var parts []string
+	if command != nil {
+		parts = append(parts, "yarn "+strings.Join(append(append([]string{}, command...), flags...), " "))
+	} else if len(flags) > 0 {
+		parts = append(parts, strings.Join(flags, " "))
+	}
+	if len(envs) > 0 {
+		parts = append(parts, strings.Join(envs, " "))
+	}
+	if len(parts) == 0 {
+		return "removed, no equivalent needed"
+	}
+	return strings.Join(parts, ", ")
+}
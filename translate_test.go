@@ -0,0 +1,161 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTranslateYarnArgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		yarnMajor uint64
+		args      []string
+		wantArgs  []string
+		wantEnvs  []string
+		wantErr   string
+	}{
+		{
+			name:      "frozen lockfile on Berry",
+			yarnMajor: 3,
+			args:      []string{"install", "--frozen-lockfile"},
+			wantArgs:  []string{"install", "--immutable"},
+		},
+		{
+			name:      "production install with frozen lockfile on Berry",
+			yarnMajor: 3,
+			args:      []string{"install", "--production", "--frozen-lockfile"},
+			wantArgs:  []string{"workspaces", "focus", "--all", "--production"},
+			wantEnvs:  []string{"YARN_ENABLE_IMMUTABLE_INSTALLS=true"},
+		},
+		{
+			name:      "production install with immutable on Berry",
+			yarnMajor: 4,
+			args:      []string{"--immutable", "--production"},
+			wantArgs:  []string{"workspaces", "focus", "--all", "--production"},
+			wantEnvs:  []string{"YARN_ENABLE_IMMUTABLE_INSTALLS=true"},
+		},
+		{
+			name:      "global flag with value on Berry",
+			yarnMajor: 3,
+			args:      []string{"--network-timeout", "100000", "install"},
+			wantArgs:  []string{"install"},
+			wantEnvs:  []string{"YARN_HTTP_TIMEOUT=100000"},
+		},
+		{
+			name:      "no equivalent on Berry",
+			yarnMajor: 3,
+			args:      []string{"install", "--pure-lockfile"},
+			wantErr:   "flag --pure-lockfile is not supported by Yarn Berry",
+		},
+		{
+			name:      "immutable on classic",
+			yarnMajor: 1,
+			args:      []string{"install", "--immutable", "--mode=skip-build"},
+			wantArgs:  []string{"install", "--frozen-lockfile", "--ignore-scripts"},
+		},
+		{
+			name:      "install only flags are kept for other commands",
+			yarnMajor: 3,
+			args:      []string{"add", "lodash", "--frozen-lockfile"},
+			wantArgs:  []string{"add", "lodash", "--frozen-lockfile"},
+		},
+		{
+			name:      "script arguments are passed on",
+			yarnMajor: 3,
+			args:      []string{"test", "--silent"},
+			wantArgs:  []string{"test", "--silent"},
+		},
+		{
+			name:      "run script arguments are passed on",
+			yarnMajor: 3,
+			args:      []string{"run", "build", "--network-timeout", "5"},
+			wantArgs:  []string{"run", "build", "--network-timeout", "5"},
+		},
+		{
+			name:      "flags before the script are translated",
+			yarnMajor: 3,
+			args:      []string{"--silent", "jest", "--silent"},
+			wantArgs:  []string{"jest", "--silent"},
+		},
+		{
+			name:      "exec arguments are passed on",
+			yarnMajor: 1,
+			args:      []string{"exec", "tool", "--immutable"},
+			wantArgs:  []string{"exec", "tool", "--immutable"},
+		},
+		{
+			name:      "workspace command arguments are passed on",
+			yarnMajor: 3,
+			args:      []string{"workspace", "app", "jest", "--silent"},
+			wantArgs:  []string{"workspace", "app", "jest", "--silent"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, envs, err := translateYarnArgs(tt.yarnMajor, tt.args, redactor{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args: got %q, want %q", args, tt.wantArgs)
+			}
+			if !reflect.DeepEqual(envs, tt.wantEnvs) {
+				t.Errorf("envs: got %q, want %q", envs, tt.wantEnvs)
+			}
+		})
+	}
+}
+
+func TestYarnOwnArgsEnd(t *testing.T) {
+	tests := []struct {
+		yarnMajor uint64
+		args      []string
+		want      int
+	}{
+		{yarnMajor: 1, args: nil, want: 0},
+		{yarnMajor: 1, args: []string{"--frozen-lockfile"}, want: 1},
+		{yarnMajor: 1, args: []string{"install", "--frozen-lockfile"}, want: 2},
+		{yarnMajor: 1, args: []string{"--cwd", "app", "install"}, want: 3},
+		{yarnMajor: 1, args: []string{"jest", "--ci"}, want: 1},
+		{yarnMajor: 1, args: []string{"test", "--ci"}, want: 1},
+		{yarnMajor: 3, args: []string{"run", "--inspect", "build", "--prod"}, want: 3},
+		{yarnMajor: 3, args: []string{"run"}, want: 1},
+		{yarnMajor: 3, args: []string{"dlx", "create-app", "--template"}, want: 1},
+		{yarnMajor: 3, args: []string{"workspace", "app", "build", "--prod"}, want: 3},
+		{yarnMajor: 3, args: []string{"workspace", "app", "add", "lodash"}, want: 4},
+	}
+
+	for _, tt := range tests {
+		if got := yarnOwnArgsEnd(tt.yarnMajor, tt.args); got != tt.want {
+			t.Errorf("yarnOwnArgsEnd(%d, %q) = %d, want %d", tt.yarnMajor, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestSubcommandIndex(t *testing.T) {
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{args: nil, want: -1},
+		{args: []string{"--version"}, want: -1},
+		{args: []string{"install"}, want: 0},
+		{args: []string{"--network-timeout", "1000", "install"}, want: 2},
+		{args: []string{"--network-timeout=1000", "install"}, want: 1},
+		{args: []string{"--silent", "build"}, want: 1},
+	}
+
+	for _, tt := range tests {
+		if got := subcommandIndex(tt.args); got != tt.want {
+			t.Errorf("subcommandIndex(%q) = %d, want %d", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Yarn classic is published as `yarn`, Yarn 2+ (Berry) releases as `@yarnpkg/cli-dist` on the npm registry.
+var yarnReleasePackages = []string{"yarn", "@yarnpkg/cli-dist"}
+
+type yarnRequirement struct {
+	spec       string
+	constraint *semver.Constraints
+}
+
+func newYarnRequirement(spec string) (*yarnRequirement, error) {
+	constraint, err := semver.NewConstraint(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Yarn version (%s): %s", spec, err)
+	}
+	return &yarnRequirement{spec: spec, constraint: constraint}, nil
+}
+
+// getYarnRequirement merges the yarn_version input and the packageManager field of package.json.
+// It returns nil if neither of them requires a specific version.
+func getYarnRequirement(inputSpec, declaredVersion string) (*yarnRequirement, error) {
+	if inputSpec == "" && declaredVersion == "" {
+		return nil, nil
+	}
+	if inputSpec == "" {
+		return newYarnRequirement(declaredVersion)
+	}
+
+	requirement, err := newYarnRequirement(inputSpec)
+	if err != nil {
+		return nil, err
+	}
+	if declaredVersion != "" {
+		declared, err := semver.NewVersion(declaredVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Yarn version in packageManager field (%s): %s", declaredVersion, err)
+		}
+		if !requirement.isSatisfiedBy(declared) {
+			return nil, fmt.Errorf("yarn_version input (%s) conflicts with the packageManager field of package.json (yarn@%s)", inputSpec, declaredVersion)
+		}
+	}
+	return requirement, nil
+}
+
+func (r *yarnRequirement) String() string {
+	return r.spec
+}
+
+func (r *yarnRequirement) isSatisfiedBy(version *semver.Version) bool {
+	if r == nil {
+		return true
+	}
+	return r.constraint.Check(version)
+}
+
+// exactVersion returns the required version if the requirement is not a range.
+func (r *yarnRequirement) exactVersion() (string, bool) {
+	version, err := semver.StrictNewVersion(strings.TrimPrefix(r.spec, "="))
+	if err != nil {
+		return "", false
+	}
+	return version.String(), true
+}
+
+// parseYarnVersion parses the output of `yarn --version`.
+// Yarn might print warnings before the version, so only the last non-empty line is considered.
+func parseYarnVersion(out string) (*semver.Version, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	last := strings.TrimSpace(lines[len(lines)-1])
+
+	version, err := semver.NewVersion(last)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected yarn version output (%s): %s", out, err)
+	}
+	return version, nil
+}
+
+// getYarnVersion returns the version of the Yarn run with the Node.js installation of nodeBinDir, if it is set.
+func getYarnVersion(yarn yarnExecutable, nodeBinDir, workDir string) (*semver.Version, error) {
+	versionCmd := yarn.withNode(nodeBinDir).command("--version").SetDir(workDir)
+	out, err := versionCmd.RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("yarn version command failed: %s, out: %s", err, out)
+	}
+	return parseYarnVersion(out)
+}
+
+// resolveYarnVersion finds the latest released Yarn version matching the requirement.
+func resolveYarnVersion(requirement *yarnRequirement, nodeBinDir string) (string, error) {
+	if version, ok := requirement.exactVersion(); ok {
+		return version, nil
+	}
+
+	var latest *semver.Version
+	for _, pkg := range yarnReleasePackages {
+		versions, err := listReleasedVersions(pkg, nodeBinDir)
+		if err != nil {
+			return "", err
+		}
+
+		for _, version := range versions {
+			if requirement.isSatisfiedBy(version) && (latest == nil || version.GreaterThan(latest)) {
+				latest = version
+			}
+		}
+	}
+
+	if latest == nil {
+		return "", fmt.Errorf("no released Yarn version matches %s", requirement)
+	}
+
+	log.Printf("Yarn %s resolved to %s", requirement, latest)
+	return latest.String(), nil
+}
+
+func listReleasedVersions(pkg, nodeBinDir string) ([]*semver.Version, error) {
+	viewCmd := nodeToolCommand(nodeBinDir, "npm", "view", pkg, "versions", "--json")
+	log.Debugf("$ %s", viewCmd.PrintableCommandArgs())
+
+	out, err := viewCmd.RunAndReturnTrimmedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s releases: %s, out: %s", pkg, err, out)
+	}
+
+	var rawVersions []string
+	if err := json.Unmarshal([]byte(out), &rawVersions); err != nil {
+		return nil, fmt.Errorf("failed to parse %s releases: %s", pkg, err)
+	}
+
+	var versions []*semver.Version
+	for _, raw := range rawVersions {
+		version, err := semver.NewVersion(raw)
+		if err != nil {
+			log.Debugf("Skipping unparsable %s release: %s", pkg, raw)
+			continue
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// workspace is a package of a Yarn workspaces monorepo.
+type workspace struct {
+	name         string
+	location     string
+	dependencies []string
+}
+
+// listWorkspaces returns the workspaces of the project (without the root workspace).
+// The list is queried from Yarn, falling back to the workspaces globs of package.json.
+func listWorkspaces(yarn yarnExecutable, yarnMajor uint64, rootDir string, pkg packageJSON) ([]workspace, error) {
+	workspaces, err := listWorkspacesWithYarn(yarn, yarnMajor, rootDir)
+	if err == nil {
+		return workspaces, nil
+	}
+	log.Warnf("Failed to list workspaces with yarn, falling back to the workspaces field of package.json: %s", err)
+
+	return listWorkspacesFromGlobs(rootDir, pkg)
+}
+
+func listWorkspacesWithYarn(yarn yarnExecutable, yarnMajor uint64, rootDir string) ([]workspace, error) {
+	if yarnMajor >= 2 {
+		out, err := yarn.command("workspaces", "list", "--json", "--verbose").SetDir(rootDir).RunAndReturnTrimmedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("%s, out: %s", err, out)
+		}
+		return parseBerryWorkspaces(out)
+	}
+
+	out, err := yarn.command("--silent", "workspaces", "info").SetDir(rootDir).RunAndReturnTrimmedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s, out: %s", err, out)
+	}
+	return parseClassicWorkspaces(out)
+}
+
+// parseClassicWorkspaces parses the output of `yarn --silent workspaces info` (Yarn classic).
+func parseClassicWorkspaces(out string) ([]workspace, error) {
+	var info map[string]struct {
+		Location              string   `json:"location"`
+		WorkspaceDependencies []string `json:"workspaceDependencies"`
+	}
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		return nil, fmt.Errorf("failed to parse workspaces info: %s", err)
+	}
+
+	var workspaces []workspace
+	for name, ws := range info {
+		workspaces = append(workspaces, workspace{name: name, location: ws.Location, dependencies: ws.WorkspaceDependencies})
+	}
+	return workspaces, nil
+}
+
+// parseBerryWorkspaces parses the output of `yarn workspaces list --json --verbose` (Yarn Berry),
+// one JSON object per line, listing workspace dependencies by location.
+func parseBerryWorkspaces(out string) ([]workspace, error) {
+	type listedWorkspace struct {
+		Name                  string   `json:"name"`
+		Location              string   `json:"location"`
+		WorkspaceDependencies []string `json:"workspaceDependencies"`
+	}
+
+	var listed []listedWorkspace
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var ws listedWorkspace
+		if err := json.Unmarshal([]byte(line), &ws); err != nil {
+			return nil, fmt.Errorf("failed to parse workspaces list: %s", err)
+		}
+		listed = append(listed, ws)
+	}
+
+	nameByLocation := map[string]string{}
+	for _, ws := range listed {
+		nameByLocation[ws.Location] = ws.Name
+	}
+
+	var workspaces []workspace
+	for _, ws := range listed {
+		if ws.Location == "." {
+			continue
+		}
+		var dependencies []string
+		for _, location := range ws.WorkspaceDependencies {
+			if name, ok := nameByLocation[location]; ok && location != "." {
+				dependencies = append(dependencies, name)
+			}
+		}
+		workspaces = append(workspaces, workspace{name: ws.Name, location: ws.Location, dependencies: dependencies})
+	}
+	return workspaces, nil
+}
+
+// listWorkspacesFromGlobs resolves the workspaces globs of package.json.
+func listWorkspacesFromGlobs(rootDir string, pkg packageJSON) ([]workspace, error) {
+	dirs, err := resolveWorkspaceDirs(rootDir, pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	packages := map[string]packageJSON{}
+	for _, dir := range dirs {
+		wsPkg, err := readPackageJSON(dir)
+		if err != nil {
+			return nil, err
+		}
+		if wsPkg.Name == "" {
+			continue
+		}
+		packages[dir] = wsPkg
+	}
+
+	names := map[string]bool{}
+	for _, wsPkg := range packages {
+		names[wsPkg.Name] = true
+	}
+
+	var workspaces []workspace
+	for dir, wsPkg := range packages {
+		location, err := filepath.Rel(rootDir, dir)
+		if err != nil {
+			return nil, err
+		}
+
+		var dependencies []string
+		for _, name := range wsPkg.dependencyNames() {
+			if names[name] {
+				dependencies = append(dependencies, name)
+			}
+		}
+		workspaces = append(workspaces, workspace{name: wsPkg.Name, location: filepath.ToSlash(location), dependencies: dependencies})
+	}
+	return workspaces, nil
+}
+
+// resolveWorkspaceDirs returns the directories matching the workspaces globs of package.json which contain a package.json.
+// Globs may contain `**` (any number of directories), and globs starting with `!` exclude the directories they match.
+func resolveWorkspaceDirs(rootDir string, pkg packageJSON) ([]string, error) {
+	var include, exclude []string
+	for _, glob := range pkg.Workspaces {
+		if strings.HasPrefix(glob, "!") {
+			exclude = append(exclude, cleanWorkspaceGlob(strings.TrimPrefix(glob, "!")))
+		} else {
+			include = append(include, cleanWorkspaceGlob(glob))
+		}
+	}
+
+	var dirs []string
+	seen := map[string]bool{}
+	for _, glob := range include {
+		matches, err := matchWorkspaceGlob(rootDir, glob)
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range matches {
+			if seen[dir] {
+				continue
+			}
+			seen[dir] = true
+
+			rel, err := filepath.Rel(rootDir, dir)
+			if err != nil {
+				return nil, err
+			}
+			excluded := false
+			for _, excludeGlob := range exclude {
+				if excluded, err = matchGlobPath(excludeGlob, filepath.ToSlash(rel)); err != nil {
+					return nil, fmt.Errorf("invalid workspaces glob (!%s): %s", excludeGlob, err)
+				} else if excluded {
+					break
+				}
+			}
+			if !excluded {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+func cleanWorkspaceGlob(glob string) string {
+	return strings.TrimPrefix(path.Clean(glob), "./")
+}
+
+// matchWorkspaceGlob returns the directories containing a package.json which match the glob.
+// Globs with `**` are matched by walking the directory tree below their static prefix,
+// without descending into node_modules, dot directories and symlinks.
+func matchWorkspaceGlob(rootDir, glob string) ([]string, error) {
+	if !strings.Contains(glob, "**") {
+		matches, err := filepath.Glob(filepath.Join(rootDir, filepath.FromSlash(glob), "package.json"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid workspaces glob (%s): %s", glob, err)
+		}
+		var dirs []string
+		for _, match := range matches {
+			dirs = append(dirs, filepath.Dir(match))
+		}
+		return dirs, nil
+	}
+
+	var prefix []string
+	for _, segment := range strings.Split(glob, "/") {
+		if strings.ContainsAny(segment, "*?[") {
+			break
+		}
+		prefix = append(prefix, segment)
+	}
+	walkRoot := filepath.Join(rootDir, filepath.FromSlash(strings.Join(prefix, "/")))
+
+	var dirs []string
+	err := filepath.WalkDir(walkRoot, func(pth string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && pth == walkRoot {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if pth != walkRoot && (entry.Name() == "node_modules" || strings.HasPrefix(entry.Name(), ".")) {
+			return filepath.SkipDir
+		}
+		// The root is not a workspace of its own
+		if pth == rootDir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(rootDir, pth)
+		if err != nil {
+			return err
+		}
+		matched, err := matchGlobPath(glob, filepath.ToSlash(rel))
+		if err != nil {
+			return fmt.Errorf("invalid workspaces glob (%s): %s", glob, err)
+		}
+		if matched {
+			if _, err := os.Stat(filepath.Join(pth, "package.json")); err == nil {
+				dirs = append(dirs, pth)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve workspaces glob (%s): %s", glob, err)
+	}
+	return dirs, nil
+}
+
+// matchGlobPath matches a slash separated path against a glob, where a `**` segment matches any number of directories.
+func matchGlobPath(glob, pth string) (bool, error) {
+	return matchGlobSegments(strings.Split(glob, "/"), strings.Split(pth, "/"))
+}
+
+func matchGlobSegments(globSegments, pathSegments []string) (bool, error) {
+	if len(globSegments) == 0 {
+		return len(pathSegments) == 0, nil
+	}
+	if globSegments[0] == "**" {
+		for i := 0; i <= len(pathSegments); i++ {
+			if matched, err := matchGlobSegments(globSegments[1:], pathSegments[i:]); err != nil || matched {
+				return matched, err
+			}
+		}
+		return false, nil
+	}
+	if len(pathSegments) == 0 {
+		return false, nil
+	}
+	matched, err := path.Match(globSegments[0], pathSegments[0])
+	if err != nil || !matched {
+		return false, err
+	}
+	return matchGlobSegments(globSegments[1:], pathSegments[1:])
+}
+
+// filterWorkspaces keeps the workspaces whose name or location matches any of the include patterns (all of them if
+// there is none) and none of the exclude patterns.
+func filterWorkspaces(workspaces []workspace, include, exclude []string) ([]workspace, error) {
+	var filtered []workspace
+	for _, ws := range workspaces {
+		included := len(include) == 0
+		if !included {
+			matched, err := matchesWorkspace(ws, include)
+			if err != nil {
+				return nil, err
+			}
+			included = matched
+		}
+
+		excluded, err := matchesWorkspace(ws, exclude)
+		if err != nil {
+			return nil, err
+		}
+
+		if included && !excluded {
+			filtered = append(filtered, ws)
+		}
+	}
+	return filtered, nil
+}
+
+func matchesWorkspace(ws workspace, patterns []string) (bool, error) {
+	for _, pattern := range patterns {
+		for _, subject := range []string{ws.name, ws.location} {
+			matched, err := path.Match(pattern, subject)
+			if err != nil {
+				return false, fmt.Errorf("invalid workspace pattern (%s): %s", pattern, err)
+			}
+			if matched {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// sortWorkspacesTopologically orders the workspaces so that every workspace comes after its workspace dependencies.
+// Workspaces without ordering constraints are sorted by name, dependency cycles are broken in name order.
+func sortWorkspacesTopologically(workspaces []workspace) []workspace {
+	byName := map[string]workspace{}
+	for _, ws := range workspaces {
+		byName[ws.name] = ws
+	}
+
+	var names []string
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sorted []workspace
+	visited := map[string]bool{}
+	visiting := map[string]bool{}
+	var visit func(name string)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		if visiting[name] {
+			log.Warnf("Workspace dependency cycle detected at %s", name)
+			return
+		}
+		visiting[name] = true
+
+		dependencies := append([]string{}, byName[name].dependencies...)
+		sort.Strings(dependencies)
+		for _, dependency := range dependencies {
+			// Dependencies filtered out of the run don't constrain the order
+			if _, ok := byName[dependency]; ok {
+				visit(dependency)
+			}
+		}
+
+		visiting[name] = false
+		visited[name] = true
+		sorted = append(sorted, byName[name])
+	}
+
+	for _, name := range names {
+		visit(name)
+	}
+	return sorted
+}
+
+// splitPatterns splits a newline or comma separated list of patterns.
+func splitPatterns(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.FieldsFunc(value, func(r rune) bool { return r == '\n' || r == ',' }) {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// workspaceResult is the outcome of running the yarn commands in a workspace.
+type workspaceResult struct {
+	workspace  workspace
+	duration   time.Duration
+	err        error
+	skipReason string
+}
+
+// selectWorkspaces returns the workspaces matching the filters in dependency order.
+func selectWorkspaces(workspaces []workspace, include, exclude string) ([]workspace, error) {
+	if len(workspaces) == 0 {
+		return nil, fmt.Errorf("no workspaces found")
+	}
+
+	filtered, err := filterWorkspaces(workspaces, splitPatterns(include), splitPatterns(exclude))
+	if err != nil {
+		return nil, err
+	}
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("none of the %d workspaces match the workspace filters", len(workspaces))
+	}
+
+	sorted := sortWorkspacesTopologically(filtered)
+	log.Infof("Running in %d workspaces:", len(sorted))
+	for _, ws := range sorted {
+		log.Printf("- %s (%s)", ws.name, ws.location)
+	}
+	return sorted, nil
+}
+
+// runInWorkspaces runs the yarn commands in the directory of every workspace. Workspaces where the command
+// is not available (like a script they don't define) are skipped.
+func (r yarnRunner) runInWorkspaces(workspaces []workspace, commandParams, args []string, commandLines [][]string, continueOnError bool) []workspaceResult {
+	var results []workspaceResult
+	failed := false
+	for i, ws := range workspaces {
+		if failed && !continueOnError {
+			results = append(results, workspaceResult{workspace: ws, skipReason: "a previous workspace failed"})
+			continue
+		}
+
+		fmt.Println()
+		log.Infof("[%d/%d] Workspace %s (%s)", i+1, len(workspaces), ws.name, ws.location)
+
+		wsRunner := r
+		wsRunner.workDir = filepath.Join(r.workDir, filepath.FromSlash(ws.location))
+		pkg, err := readPackageJSON(wsRunner.workDir)
+		if err != nil {
+			results = append(results, workspaceResult{workspace: ws, err: err})
+			failed = true
+			continue
+		}
+		wsRunner.pkg = pkg
+
+		invocations, err := wsRunner.prepareAll(commandParams, args, commandLines)
+		if err == nil {
+			err = wsRunner.checkCommandsAvailable(invocations)
+		}
+		var unknownErr *unknownCommandError
+		if errors.As(err, &unknownErr) {
+			log.Printf("Skipping workspace: %s", err)
+			results = append(results, workspaceResult{workspace: ws, skipReason: "command not available"})
+			continue
+		}
+		if err != nil {
+			results = append(results, workspaceResult{workspace: ws, err: err})
+			failed = true
+			continue
+		}
+
+		start := time.Now()
+		err = firstFailure(wsRunner.runPipeline(invocations, continueOnError))
+		results = append(results, workspaceResult{workspace: ws, duration: time.Since(start), err: err})
+		if err != nil {
+			failed = true
+		}
+	}
+
+	printWorkspaceSummary(results)
+	return results
+}
+
+// checkCommandsAvailable validates the commands preceding the first install, the ones following it might be
+// binaries of the dependencies it installs, so they are only validated right before they run.
+func (r yarnRunner) checkCommandsAvailable(invocations []yarnInvocation) error {
+	for _, invocation := range invocations {
+		if invocation.isInstall {
+			return nil
+		}
+		if err := validateYarnCommand(r.yarnVersion.Major(), r.workDir, r.rootDir, r.pkg, invocation.command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printWorkspaceSummary(results []workspaceResult) {
+	fmt.Println()
+	log.Infof("Workspaces summary:")
+	for _, result := range results {
+		line := fmt.Sprintf("%-30s %-30s", result.workspace.name, result.workspace.location)
+		switch {
+		case result.skipReason != "":
+			log.Printf("- %s skipped: %s", line, result.skipReason)
+		case result.err != nil:
+			log.Errorf("✗ %s %6.1fs failed", line, result.duration.Seconds())
+		default:
+			log.Donef("✓ %s %6.1fs passed", line, result.duration.Seconds())
+		}
+	}
+}
+
+// firstWorkspaceFailure returns the error of the first failed workspace.
+func firstWorkspaceFailure(results []workspaceResult) error {
+	ran := false
+	for _, result := range results {
+		if result.err != nil {
+			return fmt.Errorf("workspace %s: %w", result.workspace.name, result.err)
+		}
+		ran = ran || result.skipReason == ""
+	}
+	if !ran {
+		return &commandFailure{reason: "missing_script", err: fmt.Errorf("the command is not available in any of the workspaces")}
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-steputils/cache"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// findYarnCacheDir returns the directory of the Yarn package cache: the output of `yarn cache dir` on Yarn classic,
+// the cacheFolder (or the global cache if enableGlobalCache is set) of Yarn Berry.
+func findYarnCacheDir(yarn yarnExecutable, yarnMajor uint64, workDir string) (string, error) {
+	if yarnMajor < 2 {
+		out, err := yarn.command("cache", "dir").SetDir(workDir).RunAndReturnTrimmedOutput()
+		if err != nil {
+			return "", fmt.Errorf("yarn cache dir failed: %s, out: %s", err, out)
+		}
+		lines := strings.Split(out, "\n")
+		return strings.TrimSpace(lines[len(lines)-1]), nil
+	}
+
+	return findBerryCacheDir(yarnMajor, workDir)
+}
+
+func findBerryCacheDir(yarnMajor uint64, workDir string) (string, error) {
+	rc, err := readYarnrcYML(workDir)
+	if err != nil {
+		return "", err
+	}
+
+	// Yarn 4 enables the global cache by default
+	enableGlobalCache := yarnMajor >= 4
+	if rc.EnableGlobalCache != nil {
+		enableGlobalCache = *rc.EnableGlobalCache
+	}
+	if value := os.Getenv("YARN_ENABLE_GLOBAL_CACHE"); value != "" {
+		if enabled, err := strconv.ParseBool(value); err == nil {
+			enableGlobalCache = enabled
+		}
+	}
+
+	if enableGlobalCache {
+		globalFolder := berrySetting(rc.GlobalFolder, "YARN_GLOBAL_FOLDER")
+		if globalFolder == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", fmt.Errorf("failed to get home directory: %s", err)
+			}
+			globalFolder = filepath.Join(home, ".yarn", "berry")
+		}
+		return resolveProjectPath(workDir, filepath.Join(globalFolder, "cache")), nil
+	}
+
+	cacheFolder := berrySetting(rc.CacheFolder, "YARN_CACHE_FOLDER")
+	if cacheFolder == "" {
+		cacheFolder = filepath.Join(".yarn", "cache")
+	}
+	return resolveProjectPath(workDir, cacheFolder), nil
+}
+
+// berrySetting returns the value of a Yarn Berry setting, environment variables take precedence over .yarnrc.yml.
+func berrySetting(rcValue, envKey string) string {
+	if value := os.Getenv(envKey); value != "" {
+		return value
+	}
+	return expandConfigValue(rcValue)
+}
+
+func resolveProjectPath(workDir, pth string) string {
+	if filepath.IsAbs(pth) {
+		return pth
+	}
+	return filepath.Join(workDir, pth)
+}
+
+// nearestCacheIndicator returns the file whose changes invalidate the cached dependencies of a directory:
+// the nearest yarn.lock between the directory and the root directory, or the package.json of the root directory if there is none.
+func nearestCacheIndicator(dir, rootDir string) string {
+	for current := dir; ; current = filepath.Dir(current) {
+		lockfile := filepath.Join(current, yarnLockFile)
+		if _, err := os.Stat(lockfile); err == nil {
+			return lockfile
+		}
+		if current == rootDir || current == filepath.Dir(current) {
+			break
+		}
+	}
+	return filepath.Join(rootDir, "package.json")
+}
+
+// Node linkers of Yarn Berry (https://yarnpkg.com/configuration/yarnrc#nodeLinker)
+const (
+	nodeLinkerPnP         = "pnp"
+	nodeLinkerPnpm        = "pnpm"
+	nodeLinkerNodeModules = "node-modules"
+)
+
+// findNodeLinker returns how the dependencies are installed: always into node_modules on Yarn classic,
+// the nodeLinker setting (Plug'n'Play by default) on Yarn Berry.
+func findNodeLinker(yarnMajor uint64, workDir string) (string, error) {
+	if yarnMajor < 2 {
+		return nodeLinkerNodeModules, nil
+	}
+
+	rc, err := readYarnrcYML(workDir)
+	if err != nil {
+		return "", err
+	}
+	if linker := berrySetting(rc.NodeLinker, "YARN_NODE_LINKER"); linker != "" {
+		return linker, nil
+	}
+	return nodeLinkerPnP, nil
+}
+
+// berryInstallPaths returns the files and directories of a Yarn Berry install, besides node_modules, which exist:
+// the install state, and for Plug'n'Play installs the project cache, the unplugged packages and the PnP runtime.
+// The project cache is not included if the global cache is used instead.
+func berryInstallPaths(yarnMajor uint64, workDir, nodeLinker string) ([]string, error) {
+	rc, err := readYarnrcYML(workDir)
+	if err != nil {
+		return nil, err
+	}
+
+	installStatePath := berrySetting(rc.InstallStatePath, "YARN_INSTALL_STATE_PATH")
+	if installStatePath == "" {
+		installStatePath = filepath.Join(".yarn", "install-state.gz")
+	}
+	candidates := []string{resolveProjectPath(workDir, installStatePath)}
+
+	if nodeLinker == nodeLinkerPnP {
+		cacheDir, err := findBerryCacheDir(yarnMajor, workDir)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(cacheDir, workDir+string(filepath.Separator)) {
+			candidates = append(candidates, cacheDir)
+		} else {
+			log.Debugf("The global cache (%s) is used instead of a project cache, it is cached by the cache_package_cache input", cacheDir)
+		}
+
+		unpluggedFolder := berrySetting(rc.PnpUnpluggedFolder, "YARN_PNP_UNPLUGGED_FOLDER")
+		if unpluggedFolder == "" {
+			unpluggedFolder = filepath.Join(".yarn", "unplugged")
+		}
+		candidates = append(candidates,
+			resolveProjectPath(workDir, unpluggedFolder),
+			filepath.Join(workDir, ".pnp.cjs"),
+			filepath.Join(workDir, ".pnp.loader.mjs"),
+		)
+	}
+
+	var paths []string
+	for _, pth := range candidates {
+		if _, err := os.Stat(pth); err == nil {
+			paths = append(paths, pth)
+		}
+	}
+	return paths, nil
+}
+
+// findNodeModulesDirs returns the node_modules directories of the project: the ones of the root and the workspaces
+// if package.json declares workspaces, otherwise the ones found by walking the working directory.
+func findNodeModulesDirs(workDir string, pkg packageJSON, skipDirs []string) ([]string, error) {
+	start := time.Now()
+	var dirs []string
+	var err error
+	if len(pkg.Workspaces) > 0 {
+		dirs, err = findWorkspaceNodeModulesDirs(workDir, pkg)
+	} else {
+		dirs, err = walkNodeModulesDirs(workDir, skipDirs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Found %d node_modules directories in %s", len(dirs), time.Since(start).Round(time.Millisecond))
+	return dirs, nil
+}
+
+func findWorkspaceNodeModulesDirs(workDir string, pkg packageJSON) ([]string, error) {
+	workspaceDirs, err := resolveWorkspaceDirs(workDir, pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, dir := range append([]string{workDir}, workspaceDirs...) {
+		pth := filepath.Join(dir, "node_modules")
+		// Lstat, so that symlinked node_modules directories are not cached
+		if info, err := os.Lstat(pth); err == nil && info.IsDir() {
+			dirs = append(dirs, pth)
+		}
+	}
+	return dirs, nil
+}
+
+// walkNodeModulesDirs looks up the node_modules directories under the working directory, without descending into
+// node_modules directories, the skipped directories and symlinks.
+// Skipped directories without a path separator (like `.git`) match by name at any depth,
+// the rest of them (like `ios/Pods`) match the path relative to the working directory.
+func walkNodeModulesDirs(workDir string, skipDirs []string) ([]string, error) {
+	var dirs []string
+	err := filepath.WalkDir(workDir, func(pth string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Symlinks are reported as non-directory entries, so they are never followed
+		if !entry.IsDir() || pth == workDir {
+			return nil
+		}
+		if entry.Name() == "node_modules" {
+			dirs = append(dirs, pth)
+			return filepath.SkipDir
+		}
+
+		rel, err := filepath.Rel(workDir, pth)
+		if err != nil {
+			return err
+		}
+		for _, skipDir := range skipDirs {
+			target := rel
+			if !strings.Contains(skipDir, "/") {
+				target = entry.Name()
+			}
+			if matched, err := filepath.Match(filepath.FromSlash(skipDir), target); err != nil {
+				return fmt.Errorf("invalid skipped directory pattern (%s): %s", skipDir, err)
+			} else if matched {
+				log.Debugf("Skipping %s", rel)
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find node_modules directories: %s", err)
+	}
+	return dirs, nil
+}
+
+// cacheExcludePaths returns the exclude patterns of the Bitrise cache: relative paths are resolved against the
+// working directory, patterns starting with a wildcard are kept as is.
+func cacheExcludePaths(workDir string, patterns []string) []string {
+	var paths []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) && !strings.HasPrefix(pattern, "*") {
+			pattern = filepath.Join(workDir, pattern)
+		}
+		paths = append(paths, pattern)
+	}
+	return paths
+}
+
+// cacheYarnPackageCache marks the Yarn package cache to be cached, with the lockfile as change indicator.
+func cacheYarnPackageCache(yarn yarnExecutable, yarnMajor uint64, workDir string) error {
+	cacheDir, err := findYarnCacheDir(yarn, yarnMajor, workDir)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(cacheDir); err != nil {
+		return fmt.Errorf("package cache directory (%s) not found: %s", cacheDir, err)
+	}
+
+	log.Printf("Caching the Yarn package cache: %s", cacheDir)
+	yarnCache := cache.New()
+	yarnCache.IncludePath(fmt.Sprintf("%s -> %s", cacheDir, nearestCacheIndicator(workDir, workDir)))
+	if err := yarnCache.Commit(); err != nil {
+		return fmt.Errorf("failed to mark the package cache to be cached: %s", err)
+	}
+	return nil
+}
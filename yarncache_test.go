@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// createFixtureTree creates the given paths under root: paths ending with a slash are directories, the rest are files.
+func createFixtureTree(t *testing.T, root string, paths []string) {
+	t.Helper()
+	for _, pth := range paths {
+		full := filepath.Join(root, filepath.FromSlash(pth))
+		if strings.HasSuffix(pth, "/") {
+			if err := os.MkdirAll(full, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func relativePaths(t *testing.T, root string, paths []string) []string {
+	t.Helper()
+	var rels []string
+	for _, pth := range paths {
+		rel, err := filepath.Rel(root, pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rels = append(rels, filepath.ToSlash(rel))
+	}
+	return rels
+}
+
+func TestFindNodeModulesDirs(t *testing.T) {
+	tests := []struct {
+		name       string
+		tree       []string
+		symlinks   map[string]string
+		workspaces []string
+		skipDirs   []string
+		want       []string
+	}{
+		{
+			name: "walk without workspaces",
+			tree: []string{"package.json", "node_modules/a/", "app/node_modules/", "app/node_modules/b/node_modules/"},
+			want: []string{"app/node_modules", "node_modules"},
+		},
+		{
+			name:     "walk skips directories by name and by path",
+			tree:     []string{"node_modules/", ".git/modules/node_modules/", "ios/Pods/x/node_modules/", "ios/App/node_modules/", "android/build/node_modules/"},
+			skipDirs: []string{".git", "ios/Pods", "android/*"},
+			want:     []string{"ios/App/node_modules", "node_modules"},
+		},
+		{
+			name:     "walk does not follow symlinks",
+			tree:     []string{"node_modules/", "real/node_modules/", "other/"},
+			symlinks: map[string]string{"linked": "real", "other/node_modules": "../real/node_modules"},
+			want:     []string{"node_modules", "real/node_modules"},
+		},
+		{
+			name:       "workspaces",
+			tree:       []string{"node_modules/", "packages/a/package.json", "packages/a/node_modules/", "packages/b/package.json", "tools/c/node_modules/"},
+			workspaces: []string{"packages/*"},
+			want:       []string{"node_modules", "packages/a/node_modules"},
+		},
+		{
+			name: "nested workspaces with ** and negation",
+			tree: []string{
+				"node_modules/",
+				"packages/a/package.json", "packages/a/node_modules/",
+				"packages/group/b/package.json", "packages/group/b/node_modules/",
+				"packages/group/b/node_modules/c/package.json",
+				"packages/excluded/package.json", "packages/excluded/node_modules/",
+			},
+			workspaces: []string{"packages/**", "!packages/excluded"},
+			want:       []string{"node_modules", "packages/a/node_modules", "packages/group/b/node_modules"},
+		},
+		{
+			name:       "symlinked workspace node_modules",
+			tree:       []string{"node_modules/", "packages/a/package.json", "store/"},
+			symlinks:   map[string]string{"packages/a/node_modules": "../../store"},
+			workspaces: []string{"packages/*"},
+			want:       []string{"node_modules"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			createFixtureTree(t, root, tt.tree)
+			for link, target := range tt.symlinks {
+				if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(link))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dirs, err := findNodeModulesDirs(root, packageJSON{Workspaces: tt.workspaces}, tt.skipDirs)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := relativePaths(t, root, dirs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNearestCacheIndicator(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		tree []string
+		dir  string
+		want string
+	}{
+		{name: "root lockfile", tree: []string{"package.json", "yarn.lock"}, dir: ".", want: "yarn.lock"},
+		{name: "workspace uses the root lockfile", tree: []string{"package.json", "yarn.lock", "packages/a/package.json"}, dir: "packages/a", want: "yarn.lock"},
+		{name: "nearest lockfile", tree: []string{"yarn.lock", "nested/yarn.lock", "nested/app/"}, dir: "nested/app", want: "nested/yarn.lock"},
+		{name: "root package.json without lockfile", tree: []string{"package.json", ".yarn/cache/"}, dir: ".yarn", want: "package.json"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			createFixtureTree(t, root, tt.tree)
+
+			got := nearestCacheIndicator(filepath.Join(root, filepath.FromSlash(tt.dir)), root)
+			if want := filepath.Join(root, filepath.FromSlash(tt.want)); got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yarnrcYML is the subset of the Yarn 2+ (Berry) configuration file used by the step.
+type yarnrcYML struct {
+	YarnPath      string                    `yaml:"yarnPath"`
+	Plugins       []interface{}             `yaml:"plugins"`
+	NpmAuthToken  string                    `yaml:"npmAuthToken"`
+	NpmAuthIdent  string                    `yaml:"npmAuthIdent"`
+	NpmScopes     map[string]yarnrcRegistry `yaml:"npmScopes"`
+	NpmRegistries map[string]yarnrcRegistry `yaml:"npmRegistries"`
+	CacheFolder   string                    `yaml:"cacheFolder"`
+	GlobalFolder  string                    `yaml:"globalFolder"`
+	NodeLinker    string                    `yaml:"nodeLinker"`
+	// PnpUnpluggedFolder and InstallStatePath are relative to the project, if set
+	PnpUnpluggedFolder string `yaml:"pnpUnpluggedFolder"`
+	InstallStatePath   string `yaml:"installStatePath"`
+	// EnableGlobalCache is nil if not set, as its default depends on the Yarn version
+	EnableGlobalCache *bool `yaml:"enableGlobalCache"`
+}
+
+// yarnrcRegistry is the configuration of a registry or scope in .yarnrc.yml.
+type yarnrcRegistry struct {
+	NpmAuthToken string `yaml:"npmAuthToken"`
+	NpmAuthIdent string `yaml:"npmAuthIdent"`
+}
+
+// credentials returns the registry credentials of the configuration, environment variable references are not expanded.
+func (rc yarnrcYML) credentials() []string {
+	credentials := []string{rc.NpmAuthToken, rc.NpmAuthIdent}
+	for _, registries := range []map[string]yarnrcRegistry{rc.NpmScopes, rc.NpmRegistries} {
+		for _, registry := range registries {
+			credentials = append(credentials, registry.NpmAuthToken, registry.NpmAuthIdent)
+		}
+	}
+	return credentials
+}
+
+// yarnRelease is a Yarn release checked in to the repository.
+type yarnRelease struct {
+	path   string
+	source string
+}
+
+// readYarnrcYML parses the .yarnrc.yml file of the given directory.
+// A missing file is not an error, an empty model is returned instead.
+func readYarnrcYML(dir string) (yarnrcYML, error) {
+	var rc yarnrcYML
+
+	content, err := os.ReadFile(filepath.Join(dir, ".yarnrc.yml"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rc, nil
+		}
+		return rc, fmt.Errorf("failed to read .yarnrc.yml: %s", err)
+	}
+
+	if err := yaml.Unmarshal(content, &rc); err != nil {
+		return rc, fmt.Errorf("failed to parse .yarnrc.yml: %s", err)
+	}
+	return rc, nil
+}
+
+// readClassicYarnrc parses the `key value` lines of the Yarn classic .yarnrc file of the given directory.
+// A missing file is not an error, an empty map is returned instead.
+func readClassicYarnrc(dir string) (map[string]string, error) {
+	values := map[string]string{}
+
+	f, err := os.Open(filepath.Join(dir, ".yarnrc"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return values, nil
+		}
+		return nil, fmt.Errorf("failed to read .yarnrc: %s", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key := strings.Trim(fields[0], `"`)
+		values[key] = strings.Trim(strings.TrimSpace(fields[1]), `"`)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read .yarnrc: %s", err)
+	}
+	return values, nil
+}
+
+// findCheckedInYarnRelease returns the Yarn release referenced by `yarnPath` in .yarnrc.yml
+// or by `yarn-path` in .yarnrc, nil if none of them is set.
+func findCheckedInYarnRelease(dir string) (*yarnRelease, error) {
+	rc, err := readYarnrcYML(dir)
+	if err != nil {
+		return nil, err
+	}
+	if rc.YarnPath != "" {
+		return newYarnRelease(dir, rc.YarnPath, "yarnPath in .yarnrc.yml")
+	}
+
+	classicRC, err := readClassicYarnrc(dir)
+	if err != nil {
+		return nil, err
+	}
+	if pth := classicRC["yarn-path"]; pth != "" {
+		return newYarnRelease(dir, pth, "yarn-path in .yarnrc")
+	}
+
+	return nil, nil
+}
+
+func newYarnRelease(dir, pth, source string) (*yarnRelease, error) {
+	if !filepath.IsAbs(pth) {
+		pth = filepath.Join(dir, pth)
+	}
+
+	info, err := os.Stat(pth)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s points to a missing Yarn release: %s", source, pth)
+		}
+		return nil, fmt.Errorf("failed to check Yarn release referenced by %s: %s", source, err)
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s points to a directory instead of a Yarn release: %s", source, pth)
+	}
+
+	return &yarnRelease{path: pth, source: source}, nil
+}